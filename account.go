@@ -0,0 +1,90 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"net"
+	"strconv"
+)
+
+// Управляющее соединение, в котором на запрос учетной записи после PASS
+// (ответ 332) отправляется ACCT с ftp.account. jlaffaye/ftp не поддерживает
+// ACCT и ждет на PASS сразу ответ 230, поэтому ACCT отправляется из обертки
+// управляющего соединения.
+func withAccount(conn net.Conn, account string) net.Conn {
+	return &accountConn{Conn: conn, account: account, r: bufio.NewReader(conn)}
+}
+
+// Управляющее соединение, перехватывающее ответ на PASS
+type accountConn struct {
+	net.Conn
+	account string
+	r       *bufio.Reader
+	// Отправлен PASS, ответ на него еще не прочитан
+	afterPass bool
+	// Ответ, который еще не передан клиенту
+	pending []byte
+}
+
+func (c *accountConn) Write(p []byte) (int, error) {
+	if bytes.HasPrefix(p, []byte("PASS ")) {
+		c.afterPass = true
+	}
+	return c.Conn.Write(p)
+}
+
+func (c *accountConn) Read(p []byte) (int, error) {
+	if len(c.pending) == 0 && c.afterPass {
+		c.afterPass = false
+		reply, code, err := readFTPReply(c.r)
+		if err != nil {
+			return 0, err
+		}
+		if code == 332 {
+			if _, err := fmt.Fprintf(c.Conn, "ACCT %s\r\n", c.account); err != nil {
+				return 0, err
+			}
+			// Клиент получает ответ на ACCT вместо запроса учетной записи
+			reply, _, err = readFTPReply(c.r)
+			if err != nil {
+				return 0, err
+			}
+		}
+		c.pending = reply
+	}
+	if len(c.pending) > 0 {
+		n := copy(p, c.pending)
+		c.pending = c.pending[n:]
+		return n, nil
+	}
+	return c.r.Read(p)
+}
+
+// Чтение одного ответа сервера, в том числе многострочного ("230-...", "230 ...")
+func readFTPReply(r *bufio.Reader) ([]byte, int, error) {
+	var reply []byte
+	line, err := r.ReadBytes('\n')
+	if err != nil {
+		return nil, 0, err
+	}
+	reply = append(reply, line...)
+	if len(line) < 4 {
+		return reply, 0, nil
+	}
+	code, err := strconv.Atoi(string(line[:3]))
+	if err != nil {
+		return reply, 0, nil
+	}
+	if line[3] == '-' {
+		end := []byte(fmt.Sprintf("%03d ", code))
+		for !bytes.HasPrefix(line, end) {
+			line, err = r.ReadBytes('\n')
+			if err != nil {
+				return nil, 0, err
+			}
+			reply = append(reply, line...)
+		}
+	}
+	return reply, code, nil
+}
@@ -0,0 +1,81 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"time"
+)
+
+// Число неудачных проверок подряд до оповещения, если smtp.alert_after не задан
+const defaultAlertAfter = 3
+
+// Неудачные проверки подряд и отправленное оповещение (jobState)
+type alertState struct {
+	failures int
+	alerted  bool
+}
+
+// Проверка с учетом оповещений о сбоях
+func runCheckWithAlerts(run *checkRun) error {
+	err := runCheck(run)
+	trackCheckResult(run, err)
+	return err
+}
+
+// Учет результата проверки. После smtp.alert_after неудачных проверок подряд
+// на smtp.alert_to отправляется одно оповещение; следующие сбои его не
+// повторяют. После первой успешной проверки отправляется уведомление
+// о восстановлении.
+func trackCheckResult(run *checkRun, checkErr error) {
+	if len(run.SMTP.AlertTo) == 0 {
+		return
+	}
+	state := &run.state.alert
+
+	if checkErr == nil {
+		if state.alerted {
+			sendAlert(run, "проверки восстановлены",
+				fmt.Sprintf("Проверка %s снова выполняется успешно.", alertTarget(run.Config)))
+		}
+		*state = alertState{}
+		return
+	}
+
+	state.failures++
+	threshold := run.SMTP.AlertAfter
+	if threshold == 0 {
+		threshold = defaultAlertAfter
+	}
+	if state.alerted || state.failures < threshold {
+		return
+	}
+	if sendAlert(run, "проверки завершаются с ошибкой",
+		fmt.Sprintf("Проверка %s не удалась %d раз подряд.\n\nПоследняя ошибка: %v\nВремя: %s",
+			alertTarget(run.Config), state.failures, checkErr, time.Now().In(run.location).Format(time.RFC3339))) {
+		state.alerted = true
+	}
+}
+
+// Название проверки в оповещении
+func alertTarget(cfg *Config) string {
+	if cfg.Name != "" {
+		return fmt.Sprintf("задания %q (%s)", cfg.Name, cfg.FTP.Server)
+	}
+	return fmt.Sprintf("сервера %s", cfg.FTP.Server)
+}
+
+// Отправка служебного письма на smtp.alert_to; false, если отправить не удалось
+func sendAlert(run *checkRun, subject, body string) bool {
+	msg := emailMessage{
+		From:    run.SMTP.From,
+		To:      run.SMTP.AlertTo,
+		Subject: "FTP-уведомитель: " + subject,
+		Body:    body + "\n",
+	}
+	if err := newMailer(run).Send(context.Background(), msg); err != nil {
+		run.log.Error("Failed to send alert email", "error", err)
+		return false
+	}
+	run.log.Info("Alert email sent", "subject", msg.Subject)
+	return true
+}
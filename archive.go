@@ -0,0 +1,92 @@
+package main
+
+import (
+	"archive/zip"
+	"bytes"
+	"fmt"
+	"io"
+	"strings"
+)
+
+// Предельный размер архива для просмотра содержимого по умолчанию
+const defaultListZipMaxBytes = 10 << 20
+
+// Содержимое архива записи для письма (smtp.list_zip_contents). Архив
+// скачивается по TargetFile, как и остальные файлы релиза; ZipFileName
+// показывает только, что это zip. Архивы больше list_zip_max_bytes и архивы,
+// которые не удалось прочитать, пропускаются: письмо отправляется без списка.
+func zipEntries(run *checkRun, src FileSource, entry ReleaseData) []string {
+	if !strings.HasSuffix(strings.ToLower(entry.ZipFileName), ".zip") || entry.TargetFile == "" {
+		return nil
+	}
+	entries, err := zipTopLevelEntries(run.Config, src, entry.TargetFile)
+	if err != nil {
+		run.log.Warn("Failed to list archive contents", "file", entry.TargetFile, "error", err)
+		return nil
+	}
+	return entries
+}
+
+// Содержимое архива для текста письма
+func zipContentsText(entries []string) string {
+	if len(entries) == 0 {
+		return ""
+	}
+
+	text := "  Содержимое архива:\n"
+	for _, name := range entries {
+		text += fmt.Sprintf("    - %s\n", name)
+	}
+	return text
+}
+
+// Имена файлов и директорий верхнего уровня архива на сервере в порядке
+// их появления в архиве; директории - с завершающим "/"
+func zipTopLevelEntries(cfg *Config, src FileSource, remotePath string) ([]string, error) {
+	maxBytes := cfg.SMTP.ListZipMaxBytes
+	if maxBytes == 0 {
+		maxBytes = defaultListZipMaxBytes
+	}
+	// Если размер узнать не удалось, предел проверяется при скачивании
+	if size, err := src.Size(remotePath); err == nil && size > maxBytes {
+		return nil, fmt.Errorf("archive is too large: %s", formatSize(size))
+	}
+
+	var buf bytes.Buffer
+	if _, err := retrieveTo(cfg, src, remotePath, &limitedWriter{w: &buf, n: maxBytes}); err != nil {
+		return nil, err
+	}
+	archive, err := zip.NewReader(bytes.NewReader(buf.Bytes()), int64(buf.Len()))
+	if err != nil {
+		return nil, err
+	}
+
+	var names []string
+	seen := make(map[string]bool)
+	for _, file := range archive.File {
+		name := strings.TrimLeft(strings.ReplaceAll(file.Name, "\\", "/"), "/")
+		if i := strings.Index(name, "/"); i >= 0 {
+			name = name[:i+1]
+		}
+		if name == "" || seen[name] {
+			continue
+		}
+		seen[name] = true
+		names = append(names, name)
+	}
+	return names, nil
+}
+
+// Запись не больше n байт; превышение предела - ошибка
+type limitedWriter struct {
+	w io.Writer
+	n int64
+}
+
+func (l *limitedWriter) Write(p []byte) (int, error) {
+	if int64(len(p)) > l.n {
+		return 0, fmt.Errorf("archive is larger than %s", formatSize(l.n))
+	}
+	l.n -= int64(len(p))
+	return l.w.Write(p)
+}
@@ -0,0 +1,60 @@
+package main
+
+import (
+	"crypto/md5"
+	"crypto/sha1"
+	"crypto/sha256"
+	"crypto/sha512"
+	"encoding/hex"
+	"fmt"
+	"hash"
+	"strings"
+)
+
+// Конструктор хэша по имени алгоритма smtp.verify_hash; nil - проверка выключена
+func hashAlgorithm(name string) (func() hash.Hash, error) {
+	switch strings.ToLower(name) {
+	case "":
+		return nil, nil
+	case "md5":
+		return md5.New, nil
+	case "sha1":
+		return sha1.New, nil
+	case "sha256":
+		return sha256.New, nil
+	case "sha512":
+		return sha512.New, nil
+	default:
+		return nil, fmt.Errorf("unsupported algorithm %q (expected md5, sha1, sha256 or sha512)", name)
+	}
+}
+
+// Хэш для проверки файла изменений по smtp.verify_hash; nil, если проверка
+// выключена или в манифесте нет суммы
+func attachmentHash(run *checkRun, entry ReleaseData) hash.Hash {
+	newHash, _ := hashAlgorithm(run.SMTP.VerifyHash)
+	if newHash == nil {
+		return nil
+	}
+	if entry.Hash == "" {
+		run.log.Debug("Manifest has no hash, skipping verification", "file", entry.TargetFile)
+		return nil
+	}
+	return newHash()
+}
+
+// Проверка скачанного файла изменений по полю Hash манифеста; h - хэш,
+// посчитанный при скачивании (attachmentHash). Возвращает false только
+// при несовпадении суммы.
+func verifyAttachmentHash(run *checkRun, entry ReleaseData, h hash.Hash) bool {
+	if h == nil {
+		return true
+	}
+	actual := hex.EncodeToString(h.Sum(nil))
+	if !strings.EqualFold(actual, strings.TrimSpace(entry.Hash)) {
+		run.log.Warn("Attachment hash does not match manifest", "file", entry.TargetFile,
+			"algorithm", run.SMTP.VerifyHash, "expected", entry.Hash, "actual", actual)
+		return false
+	}
+	return true
+}
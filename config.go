@@ -0,0 +1,831 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"log/slog"
+	"net/url"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"text/template"
+	"time"
+
+	"github.com/robfig/cron/v3"
+	"gopkg.in/yaml.v3"
+)
+
+// Конфигурация приложения
+type Config struct {
+	FTP struct {
+		Protocol string `yaml:"protocol"` // ftp (по умолчанию) или sftp
+		Server   string `yaml:"server"`
+		Port     int    `yaml:"port"`
+		User     string `yaml:"user"`
+		Password string `yaml:"password"`
+		Dir      string `yaml:"dir"`
+		Pattern  string `yaml:"pattern"`
+		// Дополнительные маски; файл подходит, если совпала любая из масок
+		Patterns []string `yaml:"patterns"`
+		// Маски исключений: совпавшие с ними файлы не отправляются
+		Exclude []string `yaml:"exclude"`
+		// Тип масок: glob (по умолчанию, как в shell) или regex
+		PatternType string   `yaml:"pattern_type"`
+		Period      Interval `yaml:"period"`   // интервал проверок: "30s", "5m", "1h" или число минут
+		Jitter      Jitter   `yaml:"jitter"`   // случайная добавка к каждому интервалу: "10s" или "10%" периода
+		Schedule    string   `yaml:"schedule"` // расписание cron; если задано, заменяет period
+		Retries     int      `yaml:"retries"`  // повторные попытки подключения
+		// Маски без учета регистра (например, для *.JSON и *.json)
+		PatternIgnoreCase bool `yaml:"pattern_ignore_case"`
+		// Файлы, измененные позже, чем столько секунд назад, считаются
+		// недокачанными и откладываются до следующей проверки
+		MinAgeSeconds int `yaml:"min_age_seconds"`
+		// Предупреждать о файлах, которые пропали с сервера, так и не будучи
+		// отправленными (признак слишком редких проверок)
+		WarnMissed bool `yaml:"warn_missed"`
+		// Обход поддиректорий dir; max_depth ограничивает глубину (0 - по умолчанию,
+		// 32 уровня: защита от зацикленных каталогов на сервере)
+		Recursive bool `yaml:"recursive"`
+		MaxDepth  int  `yaml:"max_depth"`
+		// Число параллельных загрузок, каждая через свое соединение (по умолчанию 1)
+		Concurrency int `yaml:"concurrency"`
+		// Таймауты подключения к серверу и подключения для скачивания файла
+		// (соединение данных FTP) - по умолчанию 5s и 30s. Сама передача по
+		// времени не ограничена, ее прерывает только tick_timeout.
+		DialTimeout     time.Duration `yaml:"dial_timeout"`
+		DownloadTimeout time.Duration `yaml:"download_timeout"`
+		// Учетная запись для команды ACCT, если сервер запрашивает ее после
+		// пароля (например, на мейнфреймах); пусто - обычный вход
+		Account string `yaml:"account"`
+		// SOCKS5-прокси для исходящих соединений: socks5://[user:pass@]host:port
+		// или unix:///path/to/socket (пусто - подключение напрямую)
+		Proxy string `yaml:"proxy"`
+		// Предельный размер скачиваемого файла в байтах (0 - без ограничения)
+		MaxFileBytes int64 `yaml:"max_file_bytes"`
+		// Предельная частота команд FTP (LOGIN, LIST, RETR и др.) к серверу
+		// в секунду для всех соединений вместе (0 - без ограничения)
+		MaxOpsPerSec float64 `yaml:"max_ops_per_sec"`
+		// Интервал NOOP на простаивающем управляющем соединении (0 - не отправлять)
+		KeepaliveInterval time.Duration `yaml:"keepalive_interval"`
+		// Пассивный режим передачи данных (по умолчанию). Активный режим клиентом
+		// не поддерживается; disable_epsv заставляет использовать PASV вместо EPSV
+		Passive     *bool `yaml:"passive"`
+		DisableEPSV bool  `yaml:"disable_epsv"`
+		// FTPS: при tls=true соединение шифруется (по умолчанию явный AUTH TLS)
+		TLS           bool  `yaml:"tls"`
+		TLSExplicit   *bool `yaml:"tls_explicit"`
+		TLSSkipVerify bool  `yaml:"tls_skip_verify"`
+		// SFTP: приватный ключ и файл known_hosts для проверки ключа сервера
+		// (по умолчанию ~/.ssh/known_hosts). Проверку ключа можно отключить
+		// только явно через insecure_ignore_host_key.
+		KeyFile               string `yaml:"key_file"`
+		KnownHosts            string `yaml:"known_hosts"`
+		InsecureIgnoreHostKey bool   `yaml:"insecure_ignore_host_key"`
+	} `yaml:"ftp"`
+
+	SMTP struct {
+		Host     string   `yaml:"host"`
+		Hosts    []string `yaml:"hosts"` // резервные серверы по порядку, "хост" или "хост:порт"
+		Port     Port     `yaml:"port"`
+		From     string   `yaml:"from"`
+		Password string   `yaml:"password"`
+		Auth     string   `yaml:"auth"` // plain, login или none; пусто - автоматический выбор
+		To       []string `yaml:"to"`
+		Subject  string   `yaml:"subject"`
+		Text     string   `yaml:"text"`
+		Template string   `yaml:"template"` // путь к HTML-шаблону письма
+		Digest   bool     `yaml:"digest"`   // одно сводное письмо по всем датам вместо письма на каждую дату
+		// Прикладывать к письму исходные JSON-файлы релизов
+		AttachSourceJSON bool `yaml:"attach_source_json"`
+		// Показывать в письме тег, коммит и ветку сборки
+		ShowVCS bool `yaml:"show_vcs"`
+		// Прикладывать сводку релизов в CSV для импорта в таблицы
+		AttachCSV bool `yaml:"attach_csv"`
+		// Перечислять в письме файлы верхнего уровня zip-архивов не больше
+		// list_zip_max_bytes (по умолчанию 10 МБ)
+		ListZipContents bool  `yaml:"list_zip_contents"`
+		ListZipMaxBytes int64 `yaml:"list_zip_max_bytes"`
+		// Проверка сертификата SMTP-сервера
+		TLSSkipVerify bool   `yaml:"tls_skip_verify"`
+		TLSServerName string `yaml:"tls_server_name"`
+		// Минимальная версия TLS (1.2 по умолчанию или 1.3) и допустимые наборы
+		// шифров TLS 1.2 по именам Go, например TLS_ECDHE_RSA_WITH_AES_128_GCM_SHA256
+		MinTLSVersion string   `yaml:"min_tls_version"`
+		CipherSuites  []string `yaml:"cipher_suites"`
+		// Повторные попытки отправки при временных ошибках (4xx, сбой соединения)
+		Retries int `yaml:"retries"`
+		// Таймаут подключения и каждой операции обмена с сервером (по умолчанию 1 минута)
+		Timeout time.Duration `yaml:"timeout"`
+		// Порядок записей в письме: platform (по умолчанию), name, version, date или none
+		SortBy string `yaml:"sort_by"`
+		// Отдельные письма для получателей, которым нужны не все релизы
+		Routes []Route `yaml:"routes"`
+		// Получатели по полям манифеста для элементов smtp.to вида "{BranchName}":
+		// поле -> маска glob значения -> адреса. Каждый такой получатель получает
+		// отдельное письмо только с записями, которые к нему привели.
+		Recipients map[string]map[string][]string `yaml:"recipients"`
+		// Файлы изменений больше этого размера не прикладываются (0 - без ограничения)
+		MaxAttachmentBytes int64 `yaml:"max_attachment_bytes"`
+		// Проверка файлов изменений по полю Hash манифеста: алгоритм md5, sha1,
+		// sha256 или sha512 (пусто - не проверять); при verify_hash_strict файл
+		// с несовпадающей суммой не прикладывается
+		VerifyHash       string `yaml:"verify_hash"`
+		VerifyHashStrict bool   `yaml:"verify_hash_strict"`
+		// Письма с большим числом записей разбиваются на части (0 - без ограничения)
+		MaxEntriesPerEmail int `yaml:"max_entries_per_email"`
+		// Дополнительные заголовки письма (Reply-To, X-Priority, List-Id и т. п.)
+		Headers map[string]string `yaml:"headers"`
+		// Подпись текста письма закрытым ключом PGP (ASCII armor); подпись
+		// прикладывается файлом signature.asc
+		PGPKeyFile    string `yaml:"pgp_key_file"`
+		PGPPassphrase string `yaml:"pgp_passphrase"`
+		// Оповещение на alert_to после alert_after неудачных проверок подряд
+		// (по умолчанию 3) и уведомление о восстановлении
+		AlertTo    []string `yaml:"alert_to"`
+		AlertAfter int      `yaml:"alert_after"`
+		// Кодировка темы и текста письма (по умолчанию UTF-8)
+		Charset string `yaml:"charset"`
+	} `yaml:"smtp"`
+
+	// Часовой пояс (IANA, например Europe/Moscow) для группировки по датам
+	// и дат в письме; по умолчанию - локальный пояс процесса
+	Timezone string `yaml:"timezone"`
+
+	// Признак группировки файлов в письма: date (по дате изменения, по умолчанию)
+	// или version (по полю FullVersion/Version из JSON)
+	Grouping string `yaml:"grouping"`
+
+	// Предельная длительность одной проверки; зависшие операции прерываются
+	// (0 - без ограничения)
+	TickTimeout time.Duration `yaml:"tick_timeout"`
+
+	// Число дат, обрабатываемых параллельно, каждая через свое соединение (по умолчанию 1)
+	GroupsConcurrency int `yaml:"groups_concurrency"`
+
+	// Базовая директория для скачиваемых файлов; по умолчанию системная временная
+	DownloadDir string `yaml:"download_dir"`
+
+	// Подписи в письме: описание файла по подстроке имени архива и название платформы
+	Descriptions map[string]string `yaml:"descriptions"`
+	Platforms    map[string]string `yaml:"platforms"`
+	// Правила описания по регулярному выражению для имени архива; проверяются
+	// по порядку до descriptions, первое совпавшее правило определяет описание
+	DescriptionRules []DescriptionRule `yaml:"description_rules"`
+	// Понятные названия папок TargetFolder: по полному пути или его началу
+	Folders map[string]string `yaml:"folders"`
+	// Записи манифеста, о которых не нужно уведомлять: по платформе ("" - записи
+	// без платформы) и по подстроке имени архива, без учета регистра
+	ExcludePlatforms     []string `yaml:"exclude_platforms"`
+	ExcludeZipSubstrings []string `yaml:"exclude_zip_substrings"`
+
+	// Хранение отметок об отправленных файлах
+	State struct {
+		Backend       string `yaml:"backend"`         // file (по умолчанию) или sqlite
+		SentFilesPath string `yaml:"sent_files_path"` // путь к текстовому журналу
+		SQLitePath    string `yaml:"sqlite_path"`     // путь к базе SQLite
+		// Дедупликация: date (имя и дата, по умолчанию), hash (имя и SHA-256
+		// содержимого), name (только имя) или name_size (имя и размер). При name
+		// и name_size файл отправляется один раз, даже если сервер меняет время изменения
+		Dedup string `yaml:"dedup"`
+		// Срок хранения отметок в днях; 0 - бессрочно. Можно задать и прежним
+		// ключом sent_files.retention_days
+		RetentionDays int `yaml:"retention_days"`
+		// log - отметка на каждый файл (по умолчанию); highwater - только наибольшее
+		// время изменения обработанных файлов, более старые файлы пропускаются
+		Mode          string `yaml:"mode"`
+		HighwaterPath string `yaml:"highwater_path"` // путь к файлу отметки highwater
+	} `yaml:"state"`
+
+	// Прежнее имя state.retention_days; используется, если state.retention_days не задан
+	SentFiles struct {
+		RetentionDays int `yaml:"retention_days"`
+	} `yaml:"sent_files"`
+
+	// JSON-отчет о каждой проверке для внешних систем: mode overwrite (по
+	// умолчанию) заменяет файл, append дописывает отчет строкой в конец
+	Report struct {
+		Path string `yaml:"path"`
+		Mode string `yaml:"mode"`
+	} `yaml:"report"`
+
+	// Логирование
+	Log struct {
+		Level  string `yaml:"level"`  // debug, info (по умолчанию), warn или error
+		Format string `yaml:"format"` // text (по умолчанию) или json
+		// Файл лога вместо stderr с ротацией по размеру: max_size_mb - размер файла
+		// (по умолчанию 100), max_backups - число старых файлов (0 - хранить все)
+		File       string `yaml:"file"`
+		MaxSizeMB  int    `yaml:"max_size_mb"`
+		MaxBackups int    `yaml:"max_backups"`
+	} `yaml:"log"`
+
+	// HTTP-адрес для метрик Prometheus (например, ":9090"); пусто - не запускать
+	Metrics struct {
+		Addr string `yaml:"addr"`
+	} `yaml:"metrics"`
+
+	// HTTP-адрес для /healthz и /readyz; пусто - не запускать
+	Health struct {
+		Addr string `yaml:"addr"`
+	} `yaml:"health"`
+
+	// Копия каждого отправленного письма в папку IMAP (например, "Отправленные"
+	// общего ящика) по IMAPS; по умолчанию порт 993 и папка Sent. Имя папки
+	// указывается как в почтовом клиенте, в модифицированную UTF-7 оно
+	// переводится при сохранении.
+	IMAP struct {
+		Host          string `yaml:"host"`
+		Port          Port   `yaml:"port"`
+		User          string `yaml:"user"`
+		Password      string `yaml:"password"`
+		Folder        string `yaml:"folder"`
+		TLSSkipVerify bool   `yaml:"tls_skip_verify"`
+	} `yaml:"imap"`
+
+	// Уведомления во входящий веб-хук (Mattermost, Slack) в дополнение к письмам
+	// или вместо них (only: true)
+	Webhook struct {
+		URL  string `yaml:"url"`
+		Only bool   `yaml:"only"`
+	} `yaml:"webhook"`
+
+	// Несколько серверов в одном процессе: каждое задание выполняется по своему
+	// расписанию с общими настройками, дополненными его секциями ftp и smtp.
+	// Проверки разных заданий выполняются параллельно, каждая со своей
+	// конфигурацией; проверки одного задания не пересекаются.
+	Jobs []Job `yaml:"jobs"`
+
+	// Имя задания, для которого собрана конфигурация; пусто без jobs
+	Name string `yaml:"-"`
+	// Конфигурации заданий; без jobs - единственное задание из самой конфигурации
+	jobs []Config
+}
+
+// Настройки процесса (хранилище, логи, HTTP); проверки получают конфигурацию
+// своего задания (checkRun)
+var config Config
+
+// Номер порта; в YAML допускается как число, так и строка в кавычках ("25")
+type Port int
+
+func (p *Port) UnmarshalYAML(value *yaml.Node) error {
+	n, err := strconv.Atoi(strings.TrimSpace(value.Value))
+	if err != nil {
+		return fmt.Errorf("line %d: %q is not a valid port number", value.Line, value.Value)
+	}
+	*p = Port(n)
+	return nil
+}
+
+// Интервал: строка длительности Go ("30s", "5m", "1h") или, как в прежних
+// версиях, целое число минут
+type Interval time.Duration
+
+func (i *Interval) UnmarshalYAML(value *yaml.Node) error {
+	text := strings.TrimSpace(value.Value)
+	if minutes, err := strconv.Atoi(text); err == nil {
+		*i = Interval(time.Duration(minutes) * time.Minute)
+		return nil
+	}
+	d, err := time.ParseDuration(text)
+	if err != nil {
+		return fmt.Errorf("line %d: %q is not a valid duration or number of minutes", value.Line, value.Value)
+	}
+	*i = Interval(d)
+	return nil
+}
+
+// Разброс интервала проверок: длительность ("10s") или доля периода
+// в процентах ("10%")
+type Jitter struct {
+	Duration time.Duration
+	Percent  float64
+}
+
+func (j *Jitter) UnmarshalYAML(value *yaml.Node) error {
+	text := strings.TrimSpace(value.Value)
+	if percent, ok := strings.CutSuffix(text, "%"); ok {
+		p, err := strconv.ParseFloat(strings.TrimSpace(percent), 64)
+		if err != nil {
+			return fmt.Errorf("line %d: %q is not a valid percentage", value.Line, value.Value)
+		}
+		*j = Jitter{Percent: p}
+		return nil
+	}
+	d, err := time.ParseDuration(text)
+	if err != nil {
+		return fmt.Errorf("line %d: %q is not a valid duration or percentage", value.Line, value.Value)
+	}
+	*j = Jitter{Duration: d}
+	return nil
+}
+
+// Наибольшая добавка к интервалу period
+func (j Jitter) of(period time.Duration) time.Duration {
+	if j.Percent > 0 {
+		return time.Duration(float64(period) * j.Percent / 100)
+	}
+	return j.Duration
+}
+
+// Правило описания файла: регулярное выражение для ZipFileName и подпись
+type DescriptionRule struct {
+	Match string `yaml:"match_regex"`
+	Label string `yaml:"label"`
+	// Выражение, скомпилированное при проверке конфигурации
+	re *regexp.Regexp
+}
+
+// Путь к файлу конфигурации: флаг -config, затем переменная окружения
+// FTPNOTIFIER_CONFIG, иначе config.yaml в рабочей директории
+func resolveConfigPath(flagValue string) string {
+	if flagValue != "" {
+		return flagValue
+	}
+	if env := os.Getenv("FTPNOTIFIER_CONFIG"); env != "" {
+		return env
+	}
+	return "config.yaml"
+}
+
+// Наложение файлов *.yaml из директории dir на основную конфигурацию
+// в лексическом порядке. Если директории нет, конфигурация не меняется.
+func applyIncludes(root *yaml.Node, dir string) error {
+	paths, err := filepath.Glob(filepath.Join(dir, "*.yaml"))
+	if err != nil {
+		return fmt.Errorf("failed to list config includes: %w", err)
+	}
+	sort.Strings(paths)
+
+	for _, path := range paths {
+		content, err := os.ReadFile(path)
+		if err != nil {
+			return fmt.Errorf("failed to read config include: %w", err)
+		}
+		var include yaml.Node
+		if err := yaml.Unmarshal(content, &include); err != nil {
+			return fmt.Errorf("failed to parse config include %s: %w", path, err)
+		}
+		if len(include.Content) == 0 {
+			continue
+		}
+		if len(root.Content) == 0 {
+			*root = include
+			continue
+		}
+		mergeNode(root.Content[0], include.Content[0])
+		slog.Debug("Applied config include", "path", path)
+	}
+	return nil
+}
+
+// Слияние узлов YAML: отображения объединяются рекурсивно, списки
+// дополняются, остальные значения заменяются значениями из src
+func mergeNode(dst, src *yaml.Node) {
+	switch {
+	case dst.Kind == yaml.MappingNode && src.Kind == yaml.MappingNode:
+		for i := 0; i+1 < len(src.Content); i += 2 {
+			if value := mappingValue(dst, src.Content[i].Value); value != nil {
+				mergeNode(value, src.Content[i+1])
+			} else {
+				dst.Content = append(dst.Content, src.Content[i], src.Content[i+1])
+			}
+		}
+	case dst.Kind == yaml.SequenceNode && src.Kind == yaml.SequenceNode:
+		dst.Content = append(dst.Content, src.Content...)
+	default:
+		*dst = *src
+	}
+}
+
+// Защищает config и jobs от замены при перезагрузке; проверки копируют
+// конфигурацию задания, а перезагрузка ждет их завершения по checkMu
+var configMu sync.RWMutex
+
+// Загрузка конфигурации из YAML-файла при запуске
+func loadConfig(filename string) {
+	cfg, err := readConfig(filename)
+	if err != nil {
+		fatal("Failed to load config", "path", filename, "error", err)
+	}
+	applyConfig(cfg)
+}
+
+// Повторное чтение конфигурации (по SIGHUP). Если новая конфигурация
+// не проходит проверку, продолжает работать прежняя.
+func reloadConfig(filename string) error {
+	cfg, err := readConfig(filename)
+	if err != nil {
+		return err
+	}
+
+	// Перезагрузка дожидается завершения текущих проверок
+	checkMu.Lock()
+	defer checkMu.Unlock()
+
+	previous := config
+	applyConfig(cfg)
+	if err := setupLogging(); err != nil {
+		return err
+	}
+
+	// Хранилище и HTTP-серверы открываются один раз при запуске
+	if cfg.State != previous.State || cfg.Metrics != previous.Metrics || cfg.Health != previous.Health {
+		slog.Warn("Changes to state, metrics and health settings take effect after restart")
+	}
+	slog.Info("Config reloaded", "path", filename)
+	return nil
+}
+
+// Замена текущей конфигурации
+func applyConfig(cfg Config) {
+	configMu.Lock()
+	defer configMu.Unlock()
+	config = cfg
+	jobs = cfg.jobs
+}
+
+// Часовой пояс из конфигурации
+func configLocation(cfg Config) *time.Location {
+	loc := time.Local
+	if cfg.Timezone != "" {
+		loc, _ = time.LoadLocation(cfg.Timezone)
+	}
+	return loc
+}
+
+// Чтение и проверка конфигурации
+func readConfig(filename string) (Config, error) {
+	var cfg Config
+	file, err := os.ReadFile(filename)
+	if err != nil {
+		return cfg, fmt.Errorf("failed to read config file: %w", err)
+	}
+
+	var root yaml.Node
+	err = yaml.Unmarshal(file, &root)
+	if err != nil {
+		return cfg, fmt.Errorf("failed to parse config file: %w", err)
+	}
+
+	if err := applyIncludes(&root, filepath.Join(filepath.Dir(filename), "config.d")); err != nil {
+		return cfg, err
+	}
+
+	// Подстановка переменных окружения ${VAR} в значения
+	expandEnvNodes(&root)
+
+	err = root.Decode(&cfg)
+	if err != nil {
+		return cfg, fmt.Errorf("failed to parse config file: %w", err)
+	}
+
+	// Плоская конфигурация - одно задание без имени
+	if len(cfg.Jobs) == 0 {
+		if err := validateConfig(&cfg); err != nil {
+			return cfg, fmt.Errorf("invalid config: %w", err)
+		}
+		cfg.jobs = []Config{cfg}
+		return cfg, nil
+	}
+
+	names := make(map[string]bool)
+	for i, job := range cfg.Jobs {
+		if job.Name == "" || strings.Contains(job.Name, ":") {
+			return cfg, fmt.Errorf("invalid config: jobs[%d].name must be non-empty and must not contain ':'", i)
+		}
+		if names[job.Name] {
+			return cfg, fmt.Errorf("invalid config: duplicate job name %q", job.Name)
+		}
+		names[job.Name] = true
+
+		jobCfg, err := decodeJobConfig(&root, job)
+		if err != nil {
+			return cfg, fmt.Errorf("failed to parse config file: job %q: %w", job.Name, err)
+		}
+		if err := validateConfig(&jobCfg); err != nil {
+			return cfg, fmt.Errorf("invalid config: job %q: %w", job.Name, err)
+		}
+		cfg.jobs = append(cfg.jobs, jobCfg)
+	}
+	return cfg, nil
+}
+
+// Ссылка на переменную окружения в значении конфигурации
+var envRefPattern = regexp.MustCompile(`\$\{([A-Za-z_][A-Za-z0-9_]*)\}`)
+
+// Замена ${VAR} на значения переменных окружения во всех скалярных значениях.
+// Значения без ${...} не изменяются.
+func expandEnvNodes(node *yaml.Node) {
+	if node.Kind == yaml.ScalarNode && envRefPattern.MatchString(node.Value) {
+		node.Value = envRefPattern.ReplaceAllStringFunc(node.Value, func(ref string) string {
+			name := envRefPattern.FindStringSubmatch(ref)[1]
+			value, ok := os.LookupEnv(name)
+			if !ok {
+				slog.Warn("Environment variable referenced in config is not set", "variable", name)
+			}
+			return value
+		})
+		// Тип значения без кавычек определяется заново, чтобы ${PORT} подходил и для чисел
+		if node.Style == 0 {
+			node.Tag = ""
+		}
+	}
+	for _, child := range node.Content {
+		expandEnvNodes(child)
+	}
+}
+
+// Проверка обязательных полей и допустимых значений конфигурации
+func validateConfig(cfg *Config) error {
+	switch cfg.FTP.Protocol {
+	case "", "ftp", "sftp":
+	default:
+		return fmt.Errorf("ftp.protocol: unsupported value %q (expected ftp or sftp)", cfg.FTP.Protocol)
+	}
+	if cfg.FTP.Server == "" {
+		return fmt.Errorf("ftp.server is required")
+	}
+	if cfg.FTP.Port < 0 || cfg.FTP.Port > 65535 {
+		return fmt.Errorf("ftp.port: %d is out of range 1-65535", cfg.FTP.Port)
+	}
+	if cfg.FTP.Pattern == "" && len(cfg.FTP.Patterns) == 0 {
+		return fmt.Errorf("ftp.pattern or ftp.patterns is required")
+	}
+	switch cfg.FTP.PatternType {
+	case "", "glob", "regex":
+	default:
+		return fmt.Errorf("ftp.pattern_type: unsupported value %q (expected glob or regex)", cfg.FTP.PatternType)
+	}
+	if _, err := newFileFilter(cfg); err != nil {
+		return err
+	}
+	if cfg.FTP.Schedule != "" {
+		if _, err := cron.ParseStandard(cfg.FTP.Schedule); err != nil {
+			return fmt.Errorf("ftp.schedule: %v", err)
+		}
+	} else if cfg.FTP.Period <= 0 {
+		return fmt.Errorf("ftp.period must be positive, got %s", time.Duration(cfg.FTP.Period))
+	}
+	if cfg.FTP.Jitter.Duration < 0 || cfg.FTP.Jitter.Percent < 0 || cfg.FTP.Jitter.Percent > 100 {
+		return fmt.Errorf("ftp.jitter must be a non-negative duration or a percentage from 0%% to 100%%")
+	}
+	if cfg.FTP.MinAgeSeconds < 0 {
+		return fmt.Errorf("ftp.min_age_seconds must not be negative, got %d", cfg.FTP.MinAgeSeconds)
+	}
+	if cfg.FTP.MaxDepth < 0 {
+		return fmt.Errorf("ftp.max_depth must not be negative, got %d", cfg.FTP.MaxDepth)
+	}
+	if cfg.FTP.DialTimeout < 0 || cfg.FTP.DownloadTimeout < 0 {
+		return fmt.Errorf("ftp.dial_timeout and ftp.download_timeout must not be negative")
+	}
+	if cfg.FTP.Passive != nil && !*cfg.FTP.Passive {
+		return fmt.Errorf("ftp.passive: active mode is not supported, use passive mode (optionally with ftp.disable_epsv)")
+	}
+	if cfg.FTP.Concurrency < 0 {
+		return fmt.Errorf("ftp.concurrency must not be negative, got %d", cfg.FTP.Concurrency)
+	}
+	if cfg.FTP.Retries < 0 {
+		return fmt.Errorf("ftp.retries must not be negative, got %d", cfg.FTP.Retries)
+	}
+
+	if _, err := newLogHandler(cfg, io.Discard); err != nil {
+		return err
+	}
+	if cfg.Log.MaxSizeMB < 0 {
+		return fmt.Errorf("log.max_size_mb must not be negative, got %d", cfg.Log.MaxSizeMB)
+	}
+	if cfg.Log.MaxBackups < 0 {
+		return fmt.Errorf("log.max_backups must not be negative, got %d", cfg.Log.MaxBackups)
+	}
+
+	if cfg.Timezone != "" {
+		if _, err := time.LoadLocation(cfg.Timezone); err != nil {
+			return fmt.Errorf("timezone: %v", err)
+		}
+	}
+
+	if cfg.Webhook.URL != "" {
+		if u, err := url.Parse(cfg.Webhook.URL); err != nil || (u.Scheme != "http" && u.Scheme != "https") {
+			return fmt.Errorf("webhook.url: %q is not a valid http(s) URL", cfg.Webhook.URL)
+		}
+	} else if cfg.Webhook.Only {
+		return fmt.Errorf("webhook.only requires webhook.url")
+	}
+
+	// Без писем (webhook.only) настройки SMTP не обязательны
+	if !cfg.Webhook.Only {
+		if cfg.SMTP.Host != "" && len(cfg.SMTP.Hosts) > 0 {
+			return fmt.Errorf("set either smtp.host or smtp.hosts, not both")
+		}
+		if cfg.SMTP.Host == "" && len(cfg.SMTP.Hosts) == 0 {
+			return fmt.Errorf("smtp.host is required")
+		}
+		if _, err := smtpServers(cfg); err != nil {
+			return err
+		}
+		if cfg.SMTP.Port <= 0 || cfg.SMTP.Port > 65535 {
+			return fmt.Errorf("smtp.port: %d is out of range 1-65535", cfg.SMTP.Port)
+		}
+		if cfg.SMTP.From == "" {
+			return fmt.Errorf("smtp.from is required")
+		}
+		if len(cfg.SMTP.To) == 0 && len(cfg.SMTP.Routes) == 0 {
+			return fmt.Errorf("smtp.to must contain at least one recipient")
+		}
+	}
+	for i, to := range cfg.SMTP.To {
+		if strings.TrimSpace(to) == "" {
+			return fmt.Errorf("smtp.to[%d] is empty", i)
+		}
+		if field, ok := recipientField(to); ok {
+			if _, ok := cfg.SMTP.Recipients[field]; !ok {
+				return fmt.Errorf("smtp.to[%d]: no smtp.recipients.%s lookup table for %s", i, field, to)
+			}
+		}
+	}
+	for field, table := range cfg.SMTP.Recipients {
+		if _, ok := manifestField(ReleaseData{}, field); !ok {
+			return fmt.Errorf("smtp.recipients: %q is not a text field of the manifest", field)
+		}
+		for pattern, addresses := range table {
+			if _, err := compilePatterns([]string{pattern}, "glob", false); err != nil {
+				return fmt.Errorf("smtp.recipients.%s: %w", field, err)
+			}
+			if len(addresses) == 0 {
+				return fmt.Errorf("smtp.recipients.%s[%q] must contain at least one recipient", field, pattern)
+			}
+		}
+	}
+	if strings.Contains(cfg.SMTP.Subject, "{{") {
+		if _, err := template.New("subject").Parse(cfg.SMTP.Subject); err != nil {
+			return fmt.Errorf("smtp.subject: %v", err)
+		}
+	}
+	switch cfg.SMTP.SortBy {
+	case "", "platform", "name", "version", "date", "none":
+	default:
+		return fmt.Errorf("smtp.sort_by: unsupported value %q (expected platform, name, version, date or none)", cfg.SMTP.SortBy)
+	}
+	for i, route := range cfg.SMTP.Routes {
+		if len(route.To) == 0 {
+			return fmt.Errorf("smtp.routes[%d].to must contain at least one recipient", i)
+		}
+		if _, err := compilePatterns(route.Patterns, "glob", false); err != nil {
+			return fmt.Errorf("smtp.routes[%d].patterns: %w", i, err)
+		}
+	}
+	for i, rule := range cfg.DescriptionRules {
+		re, err := regexp.Compile(rule.Match)
+		if err != nil {
+			return fmt.Errorf("description_rules[%d].match_regex: %w", i, err)
+		}
+		cfg.DescriptionRules[i].re = re
+	}
+	if _, err := tlsVersion(cfg.SMTP.MinTLSVersion); err != nil {
+		return fmt.Errorf("smtp.min_tls_version: %w", err)
+	}
+	if _, err := cipherSuites(cfg.SMTP.CipherSuites); err != nil {
+		return fmt.Errorf("smtp.cipher_suites: %w", err)
+	}
+	if _, err := charsetEncoding(cfg.SMTP.Charset); err != nil {
+		return fmt.Errorf("smtp.charset: %w", err)
+	}
+	for name, value := range cfg.SMTP.Headers {
+		if err := validateHeaderName(name); err != nil {
+			return fmt.Errorf("smtp.headers: %w", err)
+		}
+		if strings.ContainsAny(value, "\r\n") {
+			return fmt.Errorf("smtp.headers: value of %q must be a single line", name)
+		}
+	}
+	if _, err := loadSigningKey(cfg); err != nil {
+		return fmt.Errorf("smtp.pgp_key_file: %w", err)
+	}
+	if cfg.SMTP.AlertAfter < 0 {
+		return fmt.Errorf("smtp.alert_after must not be negative, got %d", cfg.SMTP.AlertAfter)
+	}
+	if len(cfg.SMTP.AlertTo) > 0 && cfg.Webhook.Only {
+		return fmt.Errorf("smtp.alert_to requires email notifications, but webhook.only is set")
+	}
+	if cfg.SMTP.MaxEntriesPerEmail < 0 {
+		return fmt.Errorf("smtp.max_entries_per_email must not be negative, got %d", cfg.SMTP.MaxEntriesPerEmail)
+	}
+	if cfg.IMAP.Host != "" {
+		if cfg.IMAP.Port < 0 || cfg.IMAP.Port > 65535 {
+			return fmt.Errorf("imap.port: %d is out of range 1-65535", cfg.IMAP.Port)
+		}
+		if cfg.IMAP.User == "" {
+			return fmt.Errorf("imap.user is required when imap.host is set")
+		}
+		for name, value := range map[string]string{"user": cfg.IMAP.User, "password": cfg.IMAP.Password, "folder": cfg.IMAP.Folder} {
+			if strings.ContainsAny(value, "\r\n") {
+				return fmt.Errorf("imap.%s must not contain line breaks", name)
+			}
+		}
+	}
+	if _, err := hashAlgorithm(cfg.SMTP.VerifyHash); err != nil {
+		return fmt.Errorf("smtp.verify_hash: %w", err)
+	}
+	if cfg.SMTP.ListZipMaxBytes < 0 {
+		return fmt.Errorf("smtp.list_zip_max_bytes must not be negative, got %d", cfg.SMTP.ListZipMaxBytes)
+	}
+	if cfg.SMTP.MaxAttachmentBytes < 0 {
+		return fmt.Errorf("smtp.max_attachment_bytes must not be negative, got %d", cfg.SMTP.MaxAttachmentBytes)
+	}
+	if cfg.SMTP.Retries < 0 {
+		return fmt.Errorf("smtp.retries must not be negative, got %d", cfg.SMTP.Retries)
+	}
+	if cfg.SMTP.Timeout < 0 {
+		return fmt.Errorf("smtp.timeout must not be negative, got %s", cfg.SMTP.Timeout)
+	}
+	switch cfg.SMTP.Auth {
+	case "", "plain", "login", "none":
+	default:
+		return fmt.Errorf("smtp.auth: unsupported value %q (expected plain, login or none)", cfg.SMTP.Auth)
+	}
+	if cfg.SMTP.Template != "" {
+		if _, err := os.Stat(cfg.SMTP.Template); err != nil {
+			return fmt.Errorf("smtp.template: %v", err)
+		}
+	}
+
+	switch cfg.State.Backend {
+	case "", "file", "sqlite":
+	default:
+		return fmt.Errorf("state.backend: unsupported value %q (expected file or sqlite)", cfg.State.Backend)
+	}
+	switch cfg.State.Dedup {
+	case "", "date", "hash", "name", "name_size":
+	default:
+		return fmt.Errorf("state.dedup: unsupported value %q (expected date, hash, name or name_size)", cfg.State.Dedup)
+	}
+	switch cfg.State.Mode {
+	case "", "log":
+	case "highwater":
+		if cfg.State.Dedup != "" && cfg.State.Dedup != "date" {
+			return fmt.Errorf("state.dedup: %s is not supported with state.mode: highwater", cfg.State.Dedup)
+		}
+	default:
+		return fmt.Errorf("state.mode: unsupported value %q (expected log or highwater)", cfg.State.Mode)
+	}
+	switch cfg.Grouping {
+	case "", "date", "version":
+	default:
+		return fmt.Errorf("grouping: unsupported value %q (expected date or version)", cfg.Grouping)
+	}
+	if cfg.FTP.Proxy != "" {
+		if _, err := newProxyDialer(cfg.FTP.Proxy); err != nil {
+			return fmt.Errorf("ftp.proxy: %w", err)
+		}
+	}
+	if cfg.FTP.InsecureIgnoreHostKey && cfg.FTP.KnownHosts != "" {
+		return fmt.Errorf("ftp.insecure_ignore_host_key conflicts with ftp.known_hosts; set only one")
+	}
+	if cfg.FTP.Account != "" {
+		if cfg.FTP.Protocol == "sftp" {
+			return fmt.Errorf("ftp.account is not supported with sftp")
+		}
+		// Ответ на PASS перехватывается в открытом управляющем соединении
+		if cfg.FTP.TLS {
+			return fmt.Errorf("ftp.account is not supported with ftp.tls")
+		}
+		if strings.ContainsAny(cfg.FTP.Account, "\r\n") {
+			return fmt.Errorf("ftp.account must not contain line breaks")
+		}
+	}
+	if cfg.FTP.MaxFileBytes < 0 {
+		return fmt.Errorf("ftp.max_file_bytes must not be negative, got %d", cfg.FTP.MaxFileBytes)
+	}
+	if cfg.FTP.MaxOpsPerSec < 0 {
+		return fmt.Errorf("ftp.max_ops_per_sec must not be negative, got %g", cfg.FTP.MaxOpsPerSec)
+	}
+	if cfg.FTP.KeepaliveInterval < 0 {
+		return fmt.Errorf("ftp.keepalive_interval must not be negative, got %s", cfg.FTP.KeepaliveInterval)
+	}
+	switch cfg.Report.Mode {
+	case "", "overwrite", "append":
+	default:
+		return fmt.Errorf("report.mode: unsupported value %q (expected overwrite or append)", cfg.Report.Mode)
+	}
+	if cfg.TickTimeout < 0 {
+		return fmt.Errorf("tick_timeout must not be negative, got %s", cfg.TickTimeout)
+	}
+	if cfg.GroupsConcurrency < 0 {
+		return fmt.Errorf("groups_concurrency must not be negative, got %d", cfg.GroupsConcurrency)
+	}
+	if cfg.SentFiles.RetentionDays != 0 {
+		if cfg.State.RetentionDays != 0 && cfg.State.RetentionDays != cfg.SentFiles.RetentionDays {
+			return fmt.Errorf("sent_files.retention_days (%d) conflicts with state.retention_days (%d); set only one", cfg.SentFiles.RetentionDays, cfg.State.RetentionDays)
+		}
+		cfg.State.RetentionDays = cfg.SentFiles.RetentionDays
+	}
+	if cfg.State.RetentionDays < 0 {
+		return fmt.Errorf("state.retention_days must not be negative, got %d", cfg.State.RetentionDays)
+	}
+	return nil
+}
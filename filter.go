@@ -0,0 +1,110 @@
+package main
+
+import (
+	"fmt"
+	"regexp"
+	"strings"
+)
+
+// Отбор файлов по маскам: файл подходит, если совпал хотя бы с одной
+// маской ftp.pattern/ftp.patterns и ни с одной из ftp.exclude
+type fileFilter struct {
+	include []*regexp.Regexp
+	exclude []*regexp.Regexp
+}
+
+// Сборка фильтра из настроек FTP
+func newFileFilter(cfg *Config) (*fileFilter, error) {
+	var includes []string
+	if cfg.FTP.Pattern != "" {
+		includes = append(includes, cfg.FTP.Pattern)
+	}
+	includes = append(includes, cfg.FTP.Patterns...)
+
+	include, err := compilePatterns(includes, cfg.FTP.PatternType, cfg.FTP.PatternIgnoreCase)
+	if err != nil {
+		return nil, fmt.Errorf("ftp.patterns: %w", err)
+	}
+	exclude, err := compilePatterns(cfg.FTP.Exclude, cfg.FTP.PatternType, cfg.FTP.PatternIgnoreCase)
+	if err != nil {
+		return nil, fmt.Errorf("ftp.exclude: %w", err)
+	}
+	return &fileFilter{include: include, exclude: exclude}, nil
+}
+
+// Проверка имени файла
+func (f *fileFilter) Match(name string) bool {
+	for _, re := range f.exclude {
+		if re.MatchString(name) {
+			return false
+		}
+	}
+	for _, re := range f.include {
+		if re.MatchString(name) {
+			return true
+		}
+	}
+	return false
+}
+
+// Компиляция масок; при ignoreCase регистр букв в именах не учитывается
+func compilePatterns(patterns []string, patternType string, ignoreCase bool) ([]*regexp.Regexp, error) {
+	var compiled []*regexp.Regexp
+	for _, pattern := range patterns {
+		expr := patternToRegexp(pattern, patternType)
+		if ignoreCase {
+			expr = "(?i)" + expr
+		}
+		re, err := regexp.Compile(expr)
+		if err != nil {
+			return nil, fmt.Errorf("invalid pattern %q: %w", pattern, err)
+		}
+		compiled = append(compiled, re)
+	}
+	return compiled, nil
+}
+
+// Преобразование маски файлов в регулярное выражение. Маска regex
+// используется как есть, glob переводится в выражение для всего имени.
+func patternToRegexp(pattern, patternType string) string {
+	if patternType == "regex" {
+		return pattern
+	}
+	return globToRegexp(pattern)
+}
+
+// Перевод glob в регулярное выражение: * - любые символы, ? - один символ,
+// [...] - класс символов ([!...] - отрицание), остальное экранируется
+func globToRegexp(glob string) string {
+	var sb strings.Builder
+	sb.WriteString("^")
+	for i := 0; i < len(glob); i++ {
+		switch c := glob[i]; c {
+		case '*':
+			sb.WriteString("[^/]*")
+		case '?':
+			sb.WriteString("[^/]")
+		case '[':
+			end := strings.IndexByte(glob[i+1:], ']')
+			if end < 0 {
+				sb.WriteString(`\[`)
+				continue
+			}
+			class := glob[i+1 : i+1+end]
+			if strings.HasPrefix(class, "!") {
+				class = "^" + class[1:]
+			}
+			sb.WriteString("[" + class + "]")
+			i += end + 1
+		case '\\':
+			if i+1 < len(glob) {
+				i++
+			}
+			sb.WriteString(regexp.QuoteMeta(glob[i : i+1]))
+		default:
+			sb.WriteString(regexp.QuoteMeta(string(c)))
+		}
+	}
+	sb.WriteString("$")
+	return sb.String()
+}
@@ -0,0 +1,56 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"time"
+)
+
+// Процесс жив и отвечает на запросы
+func serveHealthz(w http.ResponseWriter, r *http.Request) {
+	fmt.Fprintln(w, "ok")
+}
+
+// Готовность: последняя проверка каждого задания прошла успешно и не позже
+// двух его периодов назад. При запуске по расписанию cron возраст проверки
+// не учитывается.
+func serveReadyz(w http.ResponseWriter, r *http.Request) {
+	if err := readiness(); err != nil {
+		http.Error(w, err.Error(), http.StatusServiceUnavailable)
+		return
+	}
+	fmt.Fprintln(w, "ok")
+}
+
+func readiness() error {
+	configMu.RLock()
+	defer configMu.RUnlock()
+	for _, job := range jobs {
+		if err := jobReadiness(job); err != nil {
+			if job.Name != "" {
+				return fmt.Errorf("job %q: %w", job.Name, err)
+			}
+			return err
+		}
+	}
+	return nil
+}
+
+// Готовность одного задания по результату его последней проверки
+func jobReadiness(job Config) error {
+	state := appMetrics.lastCheck(job.Name)
+	if state.failed {
+		return errors.New("last check failed")
+	}
+	if state.lastSuccessful.IsZero() {
+		return errors.New("no successful check yet")
+	}
+	if job.FTP.Schedule != "" {
+		return nil
+	}
+	if age := time.Since(state.lastSuccessful); age > 2*time.Duration(job.FTP.Period) {
+		return fmt.Errorf("last successful check was %s ago", age.Round(time.Second))
+	}
+	return nil
+}
@@ -0,0 +1,36 @@
+package main
+
+import (
+	"strings"
+	"testing"
+	"time"
+)
+
+// Сбой последней проверки одного задания делает процесс неготовым, даже если
+// позже успешно прошла проверка другого задания
+func TestReadinessPerJob(t *testing.T) {
+	appMetrics = metrics{}
+	t.Cleanup(func() { appMetrics = metrics{} })
+	saved := jobs
+	t.Cleanup(func() { jobs = saved })
+	jobs = []Config{{Name: "web"}, {Name: "mobile"}}
+	for i := range jobs {
+		jobs[i].FTP.Period = Interval(time.Minute)
+	}
+
+	appMetrics.tickSucceeded("web")
+	if err := readiness(); err == nil || !strings.Contains(err.Error(), `"mobile"`) {
+		t.Errorf("readiness = %v, want job mobile without checks", err)
+	}
+
+	appMetrics.tickFailed("web")
+	appMetrics.tickSucceeded("mobile")
+	if err := readiness(); err == nil || !strings.Contains(err.Error(), `job "web": last check failed`) {
+		t.Errorf("readiness = %v, want failed job web", err)
+	}
+
+	appMetrics.tickSucceeded("web")
+	if err := readiness(); err != nil {
+		t.Errorf("readiness = %v, want ready", err)
+	}
+}
@@ -0,0 +1,170 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"crypto/tls"
+	"encoding/base64"
+	"fmt"
+	"net"
+	"net/textproto"
+	"strconv"
+	"strings"
+	"time"
+	"unicode/utf16"
+)
+
+// Папка для копий писем по умолчанию
+const defaultIMAPFolder = "Sent"
+
+// Ограничение времени на сохранение копии, если у проверки нет своего
+const imapTimeout = 30 * time.Second
+
+// Сохранение копии отправленного письма в папку IMAP (imap.host): IMAPS,
+// вход по LOGIN и команда APPEND с флагом \Seen
+func appendToIMAP(ctx context.Context, cfg *Config, raw []byte) error {
+	port := int(cfg.IMAP.Port)
+	if port == 0 {
+		port = 993
+	}
+	addr := net.JoinHostPort(cfg.IMAP.Host, strconv.Itoa(port))
+
+	deadline := time.Now().Add(imapTimeout)
+	if ctxDeadline, ok := ctx.Deadline(); ok && ctxDeadline.Before(deadline) {
+		deadline = ctxDeadline
+	}
+	dialer := &tls.Dialer{
+		NetDialer: &net.Dialer{Deadline: deadline},
+		Config: &tls.Config{
+			ServerName:         cfg.IMAP.Host,
+			InsecureSkipVerify: cfg.IMAP.TLSSkipVerify,
+		},
+	}
+	conn, err := dialer.DialContext(ctx, "tcp", addr)
+	if err != nil {
+		return fmt.Errorf("failed to connect to IMAP server: %w", err)
+	}
+	defer conn.Close()
+	conn.SetDeadline(deadline)
+
+	c := &imapConn{r: textproto.NewReader(bufio.NewReader(conn)), w: conn}
+	greeting, err := c.r.ReadLine()
+	if err != nil {
+		return fmt.Errorf("failed to read IMAP greeting: %w", err)
+	}
+	if !strings.HasPrefix(greeting, "* OK") {
+		return fmt.Errorf("unexpected IMAP greeting: %s", greeting)
+	}
+
+	if err := c.command("LOGIN " + imapQuote(cfg.IMAP.User) + " " + imapQuote(cfg.IMAP.Password)); err != nil {
+		return fmt.Errorf("failed to login to IMAP server: %w", err)
+	}
+
+	folder := cfg.IMAP.Folder
+	if folder == "" {
+		folder = defaultIMAPFolder
+	}
+	// Письмо передается литералом после приглашения сервера "+"
+	tag := c.nextTag()
+	fmt.Fprintf(c.w, "%s APPEND %s (\\Seen) {%d}\r\n", tag, imapQuote(imapUTF7(folder)), len(raw))
+	line, err := c.r.ReadLine()
+	if err != nil {
+		return fmt.Errorf("failed to append to IMAP folder %s: %w", folder, err)
+	}
+	if !strings.HasPrefix(line, "+") {
+		return fmt.Errorf("failed to append to IMAP folder %s: %s", folder, line)
+	}
+	if _, err := c.w.Write(append(raw, "\r\n"...)); err != nil {
+		return fmt.Errorf("failed to append to IMAP folder %s: %w", folder, err)
+	}
+	if err := c.waitTagged(tag); err != nil {
+		return fmt.Errorf("failed to append to IMAP folder %s: %w", folder, err)
+	}
+
+	// Ошибка при выходе на сохраненную копию уже не влияет
+	c.command("LOGOUT")
+	return nil
+}
+
+// Управляющее соединение IMAP с нумерацией команд
+type imapConn struct {
+	r   *textproto.Reader
+	w   net.Conn
+	seq int
+}
+
+func (c *imapConn) nextTag() string {
+	c.seq++
+	return fmt.Sprintf("a%d", c.seq)
+}
+
+// Отправка команды и ожидание ее завершения
+func (c *imapConn) command(cmd string) error {
+	tag := c.nextTag()
+	if _, err := fmt.Fprintf(c.w, "%s %s\r\n", tag, cmd); err != nil {
+		return err
+	}
+	return c.waitTagged(tag)
+}
+
+// Чтение ответов до строки с тегом команды; непомеченные ответы пропускаются
+func (c *imapConn) waitTagged(tag string) error {
+	for {
+		line, err := c.r.ReadLine()
+		if err != nil {
+			return err
+		}
+		status, ok := strings.CutPrefix(line, tag+" ")
+		if !ok {
+			continue
+		}
+		if strings.HasPrefix(status, "OK") {
+			return nil
+		}
+		return fmt.Errorf("IMAP server replied: %s", status)
+	}
+}
+
+// Строка IMAP в кавычках
+func imapQuote(s string) string {
+	return `"` + strings.NewReplacer(`\`, `\\`, `"`, `\"`).Replace(s) + `"`
+}
+
+// Base64 для имен папок IMAP: "," вместо "/" и без выравнивания "="
+var imapBase64 = base64.NewEncoding("ABCDEFGHIJKLMNOPQRSTUVWXYZabcdefghijklmnopqrstuvwxyz0123456789+,").WithPadding(base64.NoPadding)
+
+// Имя папки в модифицированной UTF-7 (RFC 3501, 5.1.3): печатные символы ASCII
+// остаются как есть, "&" записывается как "&-", остальные символы кодируются
+// в UTF-16 и base64 между "&" и "-", например "Отправленные"
+func imapUTF7(name string) string {
+	var b strings.Builder
+	var pending []rune
+	flush := func() {
+		if len(pending) == 0 {
+			return
+		}
+		units := utf16.Encode(pending)
+		raw := make([]byte, 0, 2*len(units))
+		for _, u := range units {
+			raw = append(raw, byte(u>>8), byte(u))
+		}
+		b.WriteByte('&')
+		b.WriteString(imapBase64.EncodeToString(raw))
+		b.WriteByte('-')
+		pending = pending[:0]
+	}
+	for _, r := range name {
+		if r < 0x20 || r > 0x7e {
+			pending = append(pending, r)
+			continue
+		}
+		flush()
+		if r == '&' {
+			b.WriteString("&-")
+		} else {
+			b.WriteRune(r)
+		}
+	}
+	flush()
+	return b.String()
+}
@@ -0,0 +1,22 @@
+package main
+
+import "testing"
+
+// Имена папок IMAP в модифицированной UTF-7
+func TestIMAPUTF7(t *testing.T) {
+	tests := []struct {
+		name string
+		want string
+	}{
+		{name: "Sent", want: "Sent"},
+		{name: "Отправленные", want: "&BB4EQgQ,BEAEMAQyBDsENQQ9BD0ESwQ1-"},
+		{name: "Входящие/Релизы", want: "&BBIERQQ+BDQETwRJBDgENQ-/&BCAENQQ7BDgENwRL-"},
+		{name: "R&D", want: "R&-D"},
+		{name: "Релиз 2024", want: "&BCAENQQ7BDgENw- 2024"},
+	}
+	for _, tt := range tests {
+		if got := imapUTF7(tt.name); got != tt.want {
+			t.Errorf("imapUTF7(%q) = %q, want %q", tt.name, got, tt.want)
+		}
+	}
+}
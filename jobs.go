@@ -0,0 +1,208 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"log/slog"
+	"sync"
+	"time"
+
+	"github.com/jlaffaye/ftp"
+	"gopkg.in/yaml.v3"
+)
+
+// Задание: имя и собственные секции ftp и smtp, которые дополняют
+// и переопределяют общие секции конфигурации
+type Job struct {
+	Name string    `yaml:"name"`
+	FTP  yaml.Node `yaml:"ftp"`
+	SMTP yaml.Node `yaml:"smtp"`
+}
+
+// Конфигурации заданий текущей конфигурации
+var jobs []Config
+
+// Проверки заданий выполняются параллельно и держат блокировку на чтение;
+// перезагрузка конфигурации берет ее на запись и дожидается их завершения
+var checkMu sync.RWMutex
+
+// Проверка задания: конфигурация задания и его состояние между проверками.
+// Передается функциям проверки вместо общей конфигурации процесса, поэтому
+// проверки разных заданий не мешают друг другу.
+type checkRun struct {
+	// Конфигурация задания
+	*Config
+	// Часовой пояс для дат в группировке и письмах
+	location *time.Location
+	// Логгер, помечающий сообщения именем задания
+	log *slog.Logger
+	// Состояние задания, сохраняемое между проверками
+	state *jobState
+	// Временная директория текущей проверки; удаляется целиком по ее завершении
+	tickDir string
+	// Итоги текущей проверки
+	stats *tickStats
+}
+
+// Проверка задания cfg с сохраненным состоянием state
+func newCheckRun(cfg *Config, state *jobState) *checkRun {
+	logger := slog.Default()
+	if cfg.Name != "" {
+		logger = logger.With("job", cfg.Name)
+	}
+	return &checkRun{
+		Config:   cfg,
+		location: configLocation(*cfg),
+		log:      logger,
+		state:    state,
+		stats:    &tickStats{start: time.Now()},
+	}
+}
+
+// Состояние задания между проверками. Задание не проверяется параллельно
+// само с собой, поэтому состояние меняется без блокировок.
+type jobState struct {
+	// Времена изменения по modTimeKey и их точность по имени файла в отметках
+	modTimes  map[string]fileModTime
+	precision map[string]timePrecision
+	// Файлы, подходившие под маску на предыдущей проверке (ftp.warn_missed)
+	lastSeen map[string]ftp.Entry
+	// Неудачные проверки подряд и отправленное оповещение
+	alert alertState
+}
+
+func newJobState() *jobState {
+	return &jobState{
+		modTimes:  make(map[string]fileModTime),
+		precision: make(map[string]timePrecision),
+	}
+}
+
+// Состояния заданий по имени; переживают перезагрузку конфигурации
+var jobStates = struct {
+	sync.Mutex
+	m map[string]*jobState
+}{m: make(map[string]*jobState)}
+
+func jobStateOf(name string) *jobState {
+	jobStates.Lock()
+	defer jobStates.Unlock()
+	state := jobStates.m[name]
+	if state == nil {
+		state = newJobState()
+		jobStates.m[name] = state
+	}
+	return state
+}
+
+// Сборка конфигурации задания: документ конфигурации без jobs, в котором
+// ключи секций ftp и smtp задания заменяют общие
+func decodeJobConfig(root *yaml.Node, job Job) (Config, error) {
+	var cfg Config
+	if root.Kind != yaml.DocumentNode || len(root.Content) == 0 {
+		return cfg, errors.New("empty config")
+	}
+	doc := mergeMappings(root.Content[0], nil)
+	deleteMappingKey(doc, "jobs")
+	setMappingValue(doc, "ftp", mergeMappings(mappingValue(doc, "ftp"), &job.FTP))
+	setMappingValue(doc, "smtp", mergeMappings(mappingValue(doc, "smtp"), &job.SMTP))
+
+	if err := doc.Decode(&cfg); err != nil {
+		return cfg, err
+	}
+	cfg.Name = job.Name
+	return cfg, nil
+}
+
+// Новый узел-отображение с ключами base, замененными и дополненными ключами override
+func mergeMappings(base, override *yaml.Node) *yaml.Node {
+	merged := &yaml.Node{Kind: yaml.MappingNode, Tag: "!!map"}
+	for _, node := range []*yaml.Node{base, override} {
+		if node == nil || node.Kind != yaml.MappingNode {
+			continue
+		}
+		for i := 0; i+1 < len(node.Content); i += 2 {
+			setMappingValue(merged, node.Content[i].Value, node.Content[i+1])
+		}
+	}
+	return merged
+}
+
+func mappingValue(node *yaml.Node, key string) *yaml.Node {
+	for i := 0; i+1 < len(node.Content); i += 2 {
+		if node.Content[i].Value == key {
+			return node.Content[i+1]
+		}
+	}
+	return nil
+}
+
+func setMappingValue(node *yaml.Node, key string, value *yaml.Node) {
+	for i := 0; i+1 < len(node.Content); i += 2 {
+		if node.Content[i].Value == key {
+			node.Content[i+1] = value
+			return
+		}
+	}
+	keyNode := &yaml.Node{Kind: yaml.ScalarNode, Tag: "!!str", Value: key}
+	node.Content = append(node.Content, keyNode, value)
+}
+
+func deleteMappingKey(node *yaml.Node, key string) {
+	for i := 0; i+1 < len(node.Content); i += 2 {
+		if node.Content[i].Value == key {
+			node.Content = append(node.Content[:i], node.Content[i+2:]...)
+			return
+		}
+	}
+}
+
+// Проверка по заданию с номером i
+func runJob(i int) error {
+	return withJob(i, runCheckWithAlerts)
+}
+
+// Выполнение fn для задания с номером i с копией его конфигурации
+func withJob(i int, fn func(run *checkRun) error) error {
+	checkMu.RLock()
+	defer checkMu.RUnlock()
+
+	configMu.RLock()
+	if i >= len(jobs) {
+		configMu.RUnlock()
+		return nil
+	}
+	cfg := jobs[i]
+	configMu.RUnlock()
+
+	return fn(newCheckRun(&cfg, jobStateOf(cfg.Name)))
+}
+
+// Однократная проверка всех заданий по очереди
+func runAllJobs() error {
+	return forEachJob(runCheckWithAlerts)
+}
+
+// Выполнение fn для всех заданий по очереди; ошибки заданий объединяются
+func forEachJob(fn func(run *checkRun) error) error {
+	var errs []error
+	for i := range jobs {
+		if err := withJob(i, fn); err != nil {
+			if name := jobs[i].Name; name != "" {
+				err = fmt.Errorf("job %q: %w", name, err)
+			}
+			errs = append(errs, err)
+		}
+	}
+	return errors.Join(errs...)
+}
+
+// Расписания заданий; при их изменении после перезагрузки проверки перезапускаются
+func jobSchedules() []string {
+	var schedules []string
+	for _, job := range jobs {
+		period := time.Duration(job.FTP.Period)
+		schedules = append(schedules, fmt.Sprintf("%s|%s|%s|%s", job.Name, job.FTP.Schedule, period, job.FTP.Jitter.of(period)))
+	}
+	return schedules
+}
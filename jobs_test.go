@@ -0,0 +1,51 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+// Проверки разных заданий выполняются одновременно, каждая со своей
+// конфигурацией, а общие настройки процесса не подменяются
+func TestWithJobRunsJobsConcurrently(t *testing.T) {
+	config = Config{}
+	first, second := Config{Name: "first"}, Config{Name: "second"}
+	first.FTP.Server = "ftp1.example.com"
+	second.FTP.Server = "ftp2.example.com"
+	jobs = []Config{first, second}
+	t.Cleanup(func() { jobs = nil })
+
+	started := make(chan string, 2)
+	release := make(chan struct{})
+	check := func(run *checkRun) error {
+		if config.Name != "" {
+			t.Errorf("process config is replaced with job %q", config.Name)
+		}
+		started <- run.Name + " " + run.FTP.Server
+		<-release
+		return nil
+	}
+
+	done := make(chan error, 2)
+	for i := range jobs {
+		go func() { done <- withJob(i, check) }()
+	}
+	got := make(map[string]bool)
+	for range jobs {
+		select {
+		case job := <-started:
+			got[job] = true
+		case <-time.After(5 * time.Second):
+			t.Fatal("second job does not start while the first one is running")
+		}
+	}
+	close(release)
+	for range jobs {
+		if err := <-done; err != nil {
+			t.Fatal(err)
+		}
+	}
+	if !got["first ftp1.example.com"] || !got["second ftp2.example.com"] {
+		t.Errorf("checks ran with %v, want each job with its own server", got)
+	}
+}
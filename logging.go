@@ -0,0 +1,69 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"log/slog"
+	"os"
+	"strings"
+
+	"gopkg.in/natefinch/lumberjack.v2"
+)
+
+// Текущий файл лога с ротацией; nil при выводе в stderr
+var logFile *lumberjack.Logger
+
+// Настройка логирования по секции log: уровень (debug, info, warn, error),
+// формат (text или json) и файл с ротацией по размеру. По умолчанию - текст
+// с уровнем info в stderr.
+func setupLogging() error {
+	var out io.Writer = os.Stderr
+	var file *lumberjack.Logger
+	if config.Log.File != "" {
+		file = &lumberjack.Logger{
+			Filename:   config.Log.File,
+			MaxSize:    config.Log.MaxSizeMB,
+			MaxBackups: config.Log.MaxBackups,
+		}
+		out = file
+	}
+
+	handler, err := newLogHandler(&config, out)
+	if err != nil {
+		return err
+	}
+	slog.SetDefault(slog.New(handler))
+
+	// Прежний файл закрывается после переключения, например при перезагрузке
+	if logFile != nil {
+		logFile.Close()
+	}
+	logFile = file
+	return nil
+}
+
+// Обработчик логов по секции log конфигурации с выводом в out
+func newLogHandler(cfg *Config, out io.Writer) (slog.Handler, error) {
+	var level slog.Level
+	if cfg.Log.Level != "" {
+		if err := level.UnmarshalText([]byte(cfg.Log.Level)); err != nil {
+			return nil, fmt.Errorf("log.level: unsupported value %q", cfg.Log.Level)
+		}
+	}
+
+	options := &slog.HandlerOptions{Level: level}
+	switch strings.ToLower(cfg.Log.Format) {
+	case "", "text":
+		return slog.NewTextHandler(out, options), nil
+	case "json":
+		return slog.NewJSONHandler(out, options), nil
+	default:
+		return nil, fmt.Errorf("log.format: unsupported value %q (expected text or json)", cfg.Log.Format)
+	}
+}
+
+// Запись ошибки в лог и завершение процесса
+func fatal(msg string, args ...any) {
+	slog.Error(msg, args...)
+	os.Exit(1)
+}
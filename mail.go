@@ -0,0 +1,1178 @@
+package main
+
+import (
+	"bytes"
+	"cmp"
+	"context"
+	"crypto/tls"
+	"encoding/csv"
+	"errors"
+	"fmt"
+	"html/template"
+	"io"
+	"net"
+	"net/smtp"
+	"net/textproto"
+	"os"
+	"path"
+	"path/filepath"
+	"regexp"
+	"slices"
+	"strconv"
+	"strings"
+	texttemplate "text/template"
+	"time"
+
+	"golang.org/x/text/encoding"
+	"golang.org/x/text/encoding/ianaindex"
+	"golang.org/x/text/encoding/unicode"
+	"gopkg.in/gomail.v2"
+)
+
+// Данные релизов за одну дату
+type releaseGroup struct {
+	Date string
+	Data []ReleaseData
+	// Скачанные исходные JSON-файлы для вложения (smtp.attach_source_json)
+	Sources []string
+}
+
+// Данные, передаваемые в HTML-шаблон письма. В сводном письме Date содержит
+// все даты через запятую, Data - все записи, а Groups - записи по датам.
+type emailTemplateData struct {
+	Date   string
+	Data   []ReleaseData
+	Groups []releaseGroup
+}
+
+// Функции, доступные в шаблоне, чтобы подписи совпадали с текстовым письмом
+func templateFuncs(cfg *Config) template.FuncMap {
+	return template.FuncMap{
+		"platform":      func(platform string) string { return platformLabel(cfg, platform) },
+		"description":   func(zipFileName string) string { return fileDescription(cfg, zipFileName) },
+		"folder":        func(folder string) string { return folderLabel(cfg, folder) },
+		"orPlaceholder": fieldOrPlaceholder,
+		"shortSha":      shortSha,
+		"isInfo":        isInfoFile,
+	}
+}
+
+// Отправка писем по одной или нескольким датам всем получателям
+// с учетом маршрутов smtp.routes
+func sendReleaseEmail(ctx context.Context, run *checkRun, src FileSource, groups []releaseGroup) error {
+	groups = sortReleaseGroups(run.Config, groups)
+	// Файлы скачиваются один раз для всех получателей
+	files := fetchReleaseFiles(run, src, groups)
+
+	var errs []error
+	for _, d := range routeDeliveries(run.Config, groups) {
+		if err := sendReleaseEmailTo(ctx, run, d.To, d.Groups, files); err != nil {
+			errs = append(errs, fmt.Errorf("recipients %s: %w", strings.Join(d.To, ", "), err))
+		}
+	}
+	return errors.Join(errs...)
+}
+
+// Формирование и отправка письма получателям to
+func sendReleaseEmailTo(ctx context.Context, run *checkRun, to []string, groups []releaseGroup, files releaseFiles) error {
+	// Большое письмо отправляется частями; ошибка любой части возвращается,
+	// чтобы файлы не были отмечены отправленными и все части ушли повторно
+	parts := paginateGroups(groups, run.SMTP.MaxEntriesPerEmail)
+	for i, part := range parts {
+		msg, err := buildEmail(run, to, part, files)
+		if err != nil {
+			return err
+		}
+		if len(parts) > 1 {
+			msg.Subject += fmt.Sprintf(" (part %d/%d)", i+1, len(parts))
+		}
+		if err := newMailer(run).Send(ctx, msg); err != nil {
+			if len(parts) > 1 {
+				return fmt.Errorf("part %d/%d: %w", i+1, len(parts), err)
+			}
+			return err
+		}
+		run.stats.report.addEmail(to, msg.Subject)
+	}
+	return nil
+}
+
+// Разбиение групп на письма не более чем по limit записей. Группа, не
+// поместившаяся в письмо, делится между письмами с сохранением даты;
+// исходные JSON-файлы прикладываются к первой ее части.
+func paginateGroups(groups []releaseGroup, limit int) [][]releaseGroup {
+	if limit <= 0 {
+		return [][]releaseGroup{groups}
+	}
+
+	var parts [][]releaseGroup
+	var current []releaseGroup
+	count := 0
+	for _, group := range groups {
+		data := group.Data
+		sources := group.Sources
+		for {
+			if count == limit {
+				parts = append(parts, current)
+				current, count = nil, 0
+			}
+			n := min(len(data), limit-count)
+			current = append(current, releaseGroup{Date: group.Date, Data: data[:n], Sources: sources})
+			count += n
+			data, sources = data[n:], nil
+			if len(data) == 0 {
+				break
+			}
+		}
+	}
+	if len(current) > 0 {
+		parts = append(parts, current)
+	}
+	return parts
+}
+
+// Письмо, готовое к отправке
+type emailMessage struct {
+	From    string
+	To      []string
+	Subject string
+	Body    string
+	// Тело письма в HTML (smtp.template), иначе обычный текст
+	HTML bool
+	// Локальные файлы: скачанные файлы изменений и исходные JSON-файлы релизов
+	Attachments []string
+	// Файлы изменений, которые читаются с сервера прямо в письмо при отправке
+	StreamedAttachments []streamedAttachment
+	// Вложения, сформированные в памяти (сводка CSV)
+	GeneratedAttachments []generatedAttachment
+}
+
+type generatedAttachment struct {
+	Name string
+	Data []byte
+}
+
+type streamedAttachment struct {
+	Name string
+	Copy func(w io.Writer) error
+}
+
+// Способ отправки писем
+type Mailer interface {
+	Send(ctx context.Context, msg emailMessage) error
+}
+
+// Отправка через SMTP, при -dry-run - вывод в stdout
+var newMailer = func(run *checkRun) Mailer {
+	if dryRun {
+		return stdoutMailer{}
+	}
+	return smtpMailer{run}
+}
+
+// Сводка релизов в CSV (smtp.attach_csv): по строке на запись
+func releaseCSV(data []ReleaseData, loc *time.Location) ([]byte, error) {
+	var buf bytes.Buffer
+	w := csv.NewWriter(&buf)
+	w.Write([]string{"Version", "Platform", "ZipFileName", "Hash", "When", "BuildCounter"})
+	for _, entry := range data {
+		w.Write([]string{
+			entry.displayVersion(),
+			entry.Platform,
+			entry.ZipFileName,
+			entry.Hash,
+			entry.When.In(loc).Format(time.RFC3339),
+			strconv.Itoa(entry.TeamcityBuildCounter),
+		})
+	}
+	w.Flush()
+	if err := w.Error(); err != nil {
+		return nil, fmt.Errorf("failed to build CSV summary: %w", err)
+	}
+	return buf.Bytes(), nil
+}
+
+// Формирование темы, тела и списка вложений письма по одной или нескольким датам.
+// С сервером не работает: сведения о файлах релизов собраны заранее (fetchReleaseFiles).
+func buildEmail(run *checkRun, to []string, groups []releaseGroup, files releaseFiles) (emailMessage, error) {
+	msg := emailMessage{From: run.SMTP.From, To: to}
+
+	var dates []string
+	var data []ReleaseData
+	var sources []string
+	for _, group := range groups {
+		dates = append(dates, group.Date)
+		data = append(data, group.Data...)
+		sources = append(sources, group.Sources...)
+	}
+	date := strings.Join(dates, ", ")
+
+	// Создание тела письма
+	var miniVersion = 0
+	if len(groups) == 1 {
+		msg.Body = fmt.Sprintf(run.SMTP.Text+" от %s\n", date)
+		msg.Body += releaseEntriesText(run, groups[0].Data, files, &miniVersion, &msg)
+	} else {
+		// Сводное письмо: отдельный раздел на каждую дату
+		msg.Body = run.SMTP.Text + "\n"
+		for _, group := range groups {
+			msg.Body += fmt.Sprintf("\n===== %s =====\n\n", group.Date)
+			msg.Body += releaseEntriesText(run, group.Data, files, &miniVersion, &msg)
+		}
+	}
+	// Файлы изменений прикладываются перед исходными JSON-файлами
+	msg.Attachments = append(msg.Attachments, sources...)
+
+	if run.SMTP.AttachCSV {
+		summary, err := releaseCSV(data, run.location)
+		if err != nil {
+			return msg, err
+		}
+		msg.GeneratedAttachments = append(msg.GeneratedAttachments, generatedAttachment{Name: "release.csv", Data: summary})
+	}
+
+	subject, err := emailSubject(run.Config, date, miniVersion, data)
+	if err != nil {
+		return msg, err
+	}
+	msg.Subject = subject
+	if backfill.window > 0 && backfill.prefix {
+		msg.Subject = "[BACKFILL] " + msg.Subject
+	}
+
+	if run.SMTP.Template != "" {
+		// HTML-шаблон заменяет текстовое тело письма
+		html, err := renderHTMLBody(run.Config, emailTemplateData{Date: date, Data: data, Groups: groups})
+		if err != nil {
+			return msg, err
+		}
+		msg.Body = html
+		msg.HTML = true
+	}
+	return msg, nil
+}
+
+// Отправка писем через SMTP-сервер из конфигурации задания
+type smtpMailer struct {
+	run *checkRun
+}
+
+func (s smtpMailer) Send(ctx context.Context, msg emailMessage) error {
+	m, err := composeMessage(s.run.Config, msg)
+	if err != nil {
+		return err
+	}
+
+	// Дата задается заранее, чтобы копии после отправки совпадали с письмом
+	hooks := postSendHooks(s.run.Config)
+	if len(hooks) > 0 {
+		m.SetDateHeader("Date", time.Now())
+	}
+
+	// Серверы перебираются по порядку, пока один из них не примет письмо
+	servers, err := smtpServers(s.run.Config)
+	if err != nil {
+		return err
+	}
+	for i, server := range servers {
+		d, err := smtpDialer(s.run.Config, server)
+		if err != nil {
+			return err
+		}
+		err = sendWithRetry(ctx, s.run, d, m)
+		if err == nil {
+			runPostSendHooks(ctx, s.run, hooks, m)
+			return nil
+		}
+		if i == len(servers)-1 || ctx.Err() != nil {
+			return fmt.Errorf("failed to send email via %s: %w", server, err)
+		}
+		s.run.log.Warn("SMTP server failed, trying next", "server", server, "next", servers[i+1], "error", err)
+	}
+	return nil
+}
+
+// Сообщение gomail для письма: текст в кодировке smtp.charset, вложения и подпись
+func composeMessage(cfg *Config, msg emailMessage) (*gomail.Message, error) {
+	// Кодировка указывается явно в Content-Type и в закодированной теме,
+	// чтобы старые почтовые клиенты не гадали ее сами
+	charset := cmp.Or(cfg.SMTP.Charset, "UTF-8")
+	enc, err := charsetEncoding(charset)
+	if err != nil {
+		return nil, err
+	}
+	// Символы, которых нет в выбранной кодировке, заменяются на подстановочные
+	encoder := encoding.ReplaceUnsupported(enc.NewEncoder())
+	subject, err := encoder.String(msg.Subject)
+	if err != nil {
+		return nil, fmt.Errorf("failed to encode subject to %s: %w", charset, err)
+	}
+	body, err := encoder.String(msg.Body)
+	if err != nil {
+		return nil, fmt.Errorf("failed to encode body to %s: %w", charset, err)
+	}
+
+	m := gomail.NewMessage(gomail.SetCharset(charset), gomail.SetEncoding(gomail.QuotedPrintable))
+	for name, value := range cfg.SMTP.Headers {
+		m.SetHeader(textproto.CanonicalMIMEHeaderKey(name), value)
+	}
+	m.SetHeader("From", msg.From)
+	m.SetHeader("To", msg.To...)
+	m.SetHeader("Subject", subject)
+	if msg.HTML {
+		m.SetBody("text/html", body)
+	} else {
+		m.SetBody("text/plain", body)
+	}
+
+	// Файлы изменений прикладываются перед исходными JSON-файлами
+	for _, attachment := range msg.StreamedAttachments {
+		m.Attach(attachment.Name, gomail.SetCopyFunc(attachment.Copy))
+	}
+	for _, localPath := range msg.Attachments {
+		m.Attach(localPath)
+	}
+	for _, attachment := range msg.GeneratedAttachments {
+		m.Attach(attachment.Name, gomail.SetCopyFunc(func(w io.Writer) error {
+			_, err := w.Write(attachment.Data)
+			return err
+		}))
+	}
+
+	// Подпись вычисляется по тексту в той кодировке, в которой он отправляется
+	key, err := loadSigningKey(cfg)
+	if err != nil {
+		return nil, err
+	}
+	if key != nil {
+		signature, err := signBody(key, body)
+		if err != nil {
+			return nil, err
+		}
+		m.Attach(signatureAttachment,
+			gomail.SetHeader(map[string][]string{"Content-Type": {"application/pgp-signature"}}),
+			gomail.SetCopyFunc(func(w io.Writer) error {
+				_, err := w.Write(signature)
+				return err
+			}))
+	}
+	return m, nil
+}
+
+// Действие после успешной отправки письма по SMTP (например, копия в IMAP)
+type postSendHook struct {
+	name string
+	run  func(ctx context.Context, raw []byte) error
+}
+
+// Действия после отправки, включенные в конфигурации
+func postSendHooks(cfg *Config) []postSendHook {
+	var hooks []postSendHook
+	if cfg.IMAP.Host != "" {
+		hooks = append(hooks, postSendHook{name: "imap", run: func(ctx context.Context, raw []byte) error {
+			return appendToIMAP(ctx, cfg, raw)
+		}})
+	}
+	return hooks
+}
+
+// Выполнение действий после отправки. Письмо уже доставлено, поэтому ошибки
+// только записываются в лог. Вложения читаются из тех же локальных файлов,
+// что и при отправке.
+func runPostSendHooks(ctx context.Context, run *checkRun, hooks []postSendHook, m *gomail.Message) {
+	if len(hooks) == 0 {
+		return
+	}
+	var raw bytes.Buffer
+	if _, err := m.WriteTo(&raw); err != nil {
+		run.log.Warn("Failed to serialize email for post-send hooks", "error", err)
+		return
+	}
+	for _, hook := range hooks {
+		if err := hook.run(ctx, raw.Bytes()); err != nil {
+			run.log.Warn("Post-send hook failed", "hook", hook.name, "error", err)
+		}
+	}
+}
+
+// Адрес SMTP-сервера
+type smtpServer struct {
+	host string
+	port int
+}
+
+func (s smtpServer) String() string {
+	return net.JoinHostPort(s.host, strconv.Itoa(s.port))
+}
+
+// SMTP-серверы в порядке попыток: smtp.hosts или единственный smtp.host.
+// Порт, не указанный в адресе, берется из smtp.port.
+func smtpServers(cfg *Config) ([]smtpServer, error) {
+	if len(cfg.SMTP.Hosts) == 0 {
+		return []smtpServer{{host: cfg.SMTP.Host, port: int(cfg.SMTP.Port)}}, nil
+	}
+
+	servers := make([]smtpServer, 0, len(cfg.SMTP.Hosts))
+	for i, addr := range cfg.SMTP.Hosts {
+		server := smtpServer{host: addr, port: int(cfg.SMTP.Port)}
+		if host, port, err := net.SplitHostPort(addr); err == nil {
+			n, err := strconv.Atoi(port)
+			if err != nil || n <= 0 || n > 65535 {
+				return nil, fmt.Errorf("smtp.hosts[%d]: invalid port in %q", i, addr)
+			}
+			server = smtpServer{host: host, port: n}
+		}
+		if server.host == "" {
+			return nil, fmt.Errorf("smtp.hosts[%d] is empty", i)
+		}
+		servers = append(servers, server)
+	}
+	return servers, nil
+}
+
+// Заголовки, которые формирует сам уведомитель; в smtp.headers они запрещены
+var reservedHeaders = []string{"From", "To", "Cc", "Bcc", "Subject", "Date", "Mime-Version", "Content-Type", "Content-Transfer-Encoding"}
+
+// Проверка имени дополнительного заголовка: допустимые символы (RFC 5322)
+// и отсутствие среди заголовков, которые задает уведомитель
+func validateHeaderName(name string) error {
+	if name == "" {
+		return fmt.Errorf("empty header name")
+	}
+	for _, c := range name {
+		if c <= ' ' || c > '~' || c == ':' {
+			return fmt.Errorf("invalid header name %q", name)
+		}
+	}
+	if slices.Contains(reservedHeaders, textproto.CanonicalMIMEHeaderKey(name)) {
+		return fmt.Errorf("header %q is set by the notifier and cannot be overridden", name)
+	}
+	return nil
+}
+
+// Кодировка письма по имени из smtp.charset (IANA, например UTF-8, KOI8-R,
+// windows-1251); пустое имя означает UTF-8
+func charsetEncoding(name string) (encoding.Encoding, error) {
+	if name == "" {
+		return unicode.UTF8, nil
+	}
+	enc, err := ianaindex.MIME.Encoding(name)
+	if err != nil {
+		return nil, fmt.Errorf("unknown charset %q", name)
+	}
+	if enc == nil {
+		return nil, fmt.Errorf("unsupported charset %q", name)
+	}
+	return enc, nil
+}
+
+// Отправка с повторными попытками и экспоненциальной задержкой.
+// Постоянные ошибки (5xx, неверный адрес) не повторяются.
+func sendWithRetry(ctx context.Context, run *checkRun, d *gomail.Dialer, m *gomail.Message) error {
+	delay := time.Second
+	for attempt := 0; ; attempt++ {
+		_, err := withCancel(ctx, "send", func() (struct{}, error) {
+			return struct{}{}, dialAndSend(ctx, d, m, smtpTimeout(run.Config))
+		})
+		if err == nil {
+			return nil
+		}
+		if attempt >= run.SMTP.Retries || ctx.Err() != nil || !isTransientSMTPError(err) {
+			return err
+		}
+		run.log.Warn("Email sending attempt failed", "attempt", attempt+1, "attempts", run.SMTP.Retries+1, "retry_in", delay, "error", err)
+		select {
+		case <-time.After(delay):
+		case <-ctx.Done():
+			return fmt.Errorf("send cancelled: %w", ctx.Err())
+		}
+		delay *= 2
+	}
+}
+
+// Отправка письма по настройкам d в текущей горутине. У соединения есть
+// таймаут подключения и каждой операции timeout (smtp.timeout), а при отмене ctx
+// таймаут истекает сразу (connGroup). Ошибка возвращается только после того,
+// как обмен с сервером прекратился, поэтому письмо не уйдет после нее.
+func dialAndSend(ctx context.Context, d *gomail.Dialer, m *gomail.Message, timeout time.Duration) error {
+	conns := &connGroup{}
+	stop := context.AfterFunc(ctx, conns.interrupt)
+	defer stop()
+
+	dialer := &net.Dialer{Timeout: timeout}
+	raw, err := dialer.DialContext(ctx, "tcp", net.JoinHostPort(d.Host, strconv.Itoa(d.Port)))
+	if err != nil {
+		return err
+	}
+	var conn net.Conn = &timeoutConn{Conn: conns.add(raw), timeout: timeout}
+	if d.SSL {
+		conn = tls.Client(conn, d.TLSConfig)
+	}
+	c, err := smtp.NewClient(conn, d.Host)
+	if err != nil {
+		conn.Close()
+		return err
+	}
+	defer c.Close()
+
+	if d.LocalName != "" {
+		if err := c.Hello(d.LocalName); err != nil {
+			return err
+		}
+	}
+	if !d.SSL {
+		if ok, _ := c.Extension("STARTTLS"); ok {
+			if err := c.StartTLS(d.TLSConfig); err != nil {
+				return err
+			}
+		}
+	}
+	if auth := smtpAuth(c, d); auth != nil {
+		if err := c.Auth(auth); err != nil {
+			return err
+		}
+	}
+
+	send := gomail.SendFunc(func(from string, to []string, msg io.WriterTo) error {
+		if err := c.Mail(from); err != nil {
+			return err
+		}
+		for _, addr := range to {
+			if err := c.Rcpt(addr); err != nil {
+				return err
+			}
+		}
+		w, err := c.Data()
+		if err != nil {
+			return err
+		}
+		if _, err := msg.WriteTo(w); err != nil {
+			w.Close()
+			return err
+		}
+		return w.Close()
+	})
+	if err := gomail.Send(send, m); err != nil {
+		return err
+	}
+	return c.Quit()
+}
+
+// Механизм авторизации: заданный в d или, как в gomail, выбранный по списку
+// AUTH, объявленному сервером
+func smtpAuth(c *smtp.Client, d *gomail.Dialer) smtp.Auth {
+	if d.Auth != nil || d.Username == "" {
+		return d.Auth
+	}
+	ok, auths := c.Extension("AUTH")
+	switch {
+	case !ok:
+		return nil
+	case strings.Contains(auths, "CRAM-MD5"):
+		return smtp.CRAMMD5Auth(d.Username, d.Password)
+	case strings.Contains(auths, "LOGIN") && !strings.Contains(auths, "PLAIN"):
+		return &loginAuth{username: d.Username, password: d.Password, host: d.Host}
+	default:
+		return smtp.PlainAuth("", d.Username, d.Password, d.Host)
+	}
+}
+
+// Таймаут подключения и ожидания SMTP-сервера
+func smtpTimeout(cfg *Config) time.Duration {
+	if cfg.SMTP.Timeout > 0 {
+		return cfg.SMTP.Timeout
+	}
+	return time.Minute
+}
+
+// Соединение с таймаутом на каждую операцию: зависший сервер прерывает
+// отправку через timeout, а передача большого письма не ограничена по времени
+type timeoutConn struct {
+	net.Conn
+	timeout time.Duration
+}
+
+func (c *timeoutConn) Read(b []byte) (int, error) {
+	c.Conn.SetDeadline(time.Now().Add(c.timeout))
+	return c.Conn.Read(b)
+}
+
+func (c *timeoutConn) Write(b []byte) (int, error) {
+	c.Conn.SetDeadline(time.Now().Add(c.timeout))
+	return c.Conn.Write(b)
+}
+
+// Код ответа SMTP в тексте ошибки: gomail теряет тип textproto.Error при отправке
+var smtpReplyCode = regexp.MustCompile(`(?:^|: )([2-5])\d\d[ -]`)
+
+// Временная ошибка SMTP: ответ 4xx или сбой соединения без кода ответа
+func isTransientSMTPError(err error) bool {
+	var protoErr *textproto.Error
+	if errors.As(err, &protoErr) {
+		return protoErr.Code >= 400 && protoErr.Code < 500
+	}
+	if match := smtpReplyCode.FindStringSubmatch(err.Error()); match != nil {
+		return match[1] == "4"
+	}
+	if strings.Contains(err.Error(), "invalid address") {
+		return false
+	}
+	return true
+}
+
+// Вывод письма в stdout вместо отправки (-dry-run)
+type stdoutMailer struct{}
+
+func (stdoutMailer) Send(ctx context.Context, msg emailMessage) error {
+	var sb strings.Builder
+	sb.WriteString("===== DRY RUN: email not sent =====\n")
+	fmt.Fprintf(&sb, "From: %s\n", msg.From)
+	fmt.Fprintf(&sb, "To: %s\n", strings.Join(msg.To, ", "))
+	fmt.Fprintf(&sb, "Subject: %s\n", msg.Subject)
+	for _, attachment := range msg.StreamedAttachments {
+		fmt.Fprintf(&sb, "Attachment: %s\n", attachment.Name)
+	}
+	for _, attachment := range msg.Attachments {
+		fmt.Fprintf(&sb, "Attachment: %s\n", filepath.Base(attachment))
+	}
+	for _, attachment := range msg.GeneratedAttachments {
+		fmt.Fprintf(&sb, "Attachment: %s (%s)\n", attachment.Name, formatSize(int64(len(attachment.Data))))
+	}
+	sb.WriteString("\n")
+	sb.WriteString(msg.Body)
+	sb.WriteString("\n")
+	_, err := os.Stdout.WriteString(sb.String())
+	return err
+}
+
+// Данные для шаблона темы письма. Latest - запись с наибольшим номером сборки,
+// Product - последняя часть ее TargetFolder.
+type subjectData struct {
+	Date    string
+	Build   int
+	Version string
+	Branch  string
+	Product string
+	Count   int
+	Latest  ReleaseData
+	Data    []ReleaseData
+}
+
+// Тема письма. Если smtp.subject содержит {{...}}, он выполняется как шаблон
+// text/template, иначе тема формируется в прежнем формате "тема - сборка  дата".
+func emailSubject(cfg *Config, date string, build int, data []ReleaseData) (string, error) {
+	if !strings.Contains(cfg.SMTP.Subject, "{{") {
+		return fmt.Sprintf("%s - %d  %s", cfg.SMTP.Subject, build, date), nil
+	}
+
+	tmpl, err := texttemplate.New("subject").Parse(cfg.SMTP.Subject)
+	if err != nil {
+		return "", fmt.Errorf("failed to parse subject template: %w", err)
+	}
+
+	var latest ReleaseData
+	for i, entry := range data {
+		if i == 0 || entry.TeamcityBuildCounter > latest.TeamcityBuildCounter {
+			latest = entry
+		}
+	}
+	var buf bytes.Buffer
+	err = tmpl.Execute(&buf, subjectData{
+		Date:    date,
+		Build:   build,
+		Version: latest.displayVersion(),
+		Branch:  latest.BranchName,
+		Product: path.Base(strings.ReplaceAll(latest.TargetFolder, "\\", "/")),
+		Count:   len(data),
+		Latest:  latest,
+		Data:    data,
+	})
+	if err != nil {
+		return "", fmt.Errorf("failed to render subject template: %w", err)
+	}
+	// Тема письма - одна строка
+	return strings.Join(strings.Fields(buf.String()), " "), nil
+}
+
+// Упорядочивание записей в группах по smtp.sort_by, чтобы порядок в письме
+// не зависел от порядка файлов на сервере и записей в манифесте
+func sortReleaseGroups(cfg *Config, groups []releaseGroup) []releaseGroup {
+	if cfg.SMTP.SortBy == "none" {
+		return groups
+	}
+
+	sorted := make([]releaseGroup, len(groups))
+	for i, group := range groups {
+		group.Data = slices.Clone(group.Data)
+		slices.SortStableFunc(group.Data, func(a, b ReleaseData) int {
+			return compareReleaseData(cfg.SMTP.SortBy, a, b)
+		})
+		sorted[i] = group
+	}
+	return sorted
+}
+
+// Сравнение записей по ключу sortBy (smtp.sort_by); при равенстве - по имени архива
+func compareReleaseData(sortBy string, a, b ReleaseData) int {
+	var c int
+	switch sortBy {
+	case "", "platform":
+		c = strings.Compare(a.Platform, b.Platform)
+	case "version":
+		c = cmp.Or(cmp.Compare(a.Major, b.Major), cmp.Compare(a.Minor, b.Minor),
+			cmp.Compare(a.Patch, b.Patch), cmp.Compare(a.Build, b.Build))
+	case "date":
+		c = a.When.Compare(b.When)
+	}
+	if c != 0 {
+		return c
+	}
+	return strings.Compare(a.ZipFileName, b.ZipFileName)
+}
+
+// Встроенные подписи платформ; config.Platforms дополняет и переопределяет их
+var defaultPlatforms = map[string]string{
+	"none": "Не подразумевается",
+}
+
+// Встроенные описания файлов по подстроке имени архива; config.Descriptions дополняет и переопределяет их
+var defaultDescriptions = map[string]string{
+	"info":    "Информация об изменениях",
+	"web":     "Веб-клиент",
+	"any-cpu": "Универсальная сборка для win, mac, debian (требуется .net)",
+}
+
+// Описание файла, если ни одна подстрока не совпала
+const defaultDescription = "Сервисы"
+
+// Текст с описанием файлов релиза. Файлы изменений добавляются во вложения msg;
+// miniVersion - наибольший номер сборки среди записей для темы письма.
+func releaseEntriesText(run *checkRun, data []ReleaseData, files releaseFiles, miniVersion *int, msg *emailMessage) string {
+	var body string
+	for i, entry := range data {
+		file := files[entry.TargetFile]
+		plat := platformLabel(run.Config, entry.Platform)
+		description := fileDescription(run.Config, entry.ZipFileName)
+
+		body += fmt.Sprintf("  Файл %d:\n", i+1)
+		body += fmt.Sprintf("  Описание: %s\n", description)
+		body += fmt.Sprintf("  Папка файла: %s\n", folderLabel(run.Config, entry.TargetFolder))
+		body += fmt.Sprintf("  Файл: %s\n", fieldOrPlaceholder(entry.TargetFile, "TargetFile"))
+		body += fmt.Sprintf("  Имя архива: %s\n", fieldOrPlaceholder(entry.ZipFileName, "ZipFileName"))
+		body += zipContentsText(file.ZipEntries)
+		body += fmt.Sprintf("  Платформа: %s\n", fieldOrPlaceholder(plat, "Platform"))
+		body += fmt.Sprintf("  Версия: %s\n", fieldOrPlaceholder(entry.displayVersion(), "Version"))
+		if run.SMTP.ShowVCS {
+			body += vcsText(entry)
+		}
+		body += fmt.Sprintf("  Дата: %s\n", entry.When.In(run.location).Format(time.RFC3339))
+		body += fmt.Sprintf("  Версия сборки: %d\n", entry.TeamcityBuildCounter)
+		body += "\n"
+		*miniVersion = max(*miniVersion, entry.TeamcityBuildCounter)
+
+		// Проверяем, содержит ли TargetFile подстроку "info"
+		if isInfoFile(entry) {
+			switch {
+			case file.TooLarge > 0:
+				body += fmt.Sprintf("Файл изменений %s не приложен (слишком большой: %s)\n", entry.TargetFile, formatSize(file.TooLarge))
+			case file.HashMismatch:
+				body += fmt.Sprintf("Файл изменений %s не приложен (контрольная сумма не совпадает)\n", entry.TargetFile)
+			case file.DownloadFailed:
+				body += fmt.Sprintf("Файл изменений %s не приложен (не удалось скачать)\n", entry.TargetFile)
+			case file.Stream != nil:
+				body += fmt.Sprintf("К письму прикреплен файл измнений: %s\n", entry.TargetFile)
+				msg.StreamedAttachments = append(msg.StreamedAttachments,
+					streamedAttachment{Name: path.Base(entry.TargetFile), Copy: file.Stream})
+			case file.Attachment != "":
+				// Прикрепляем файл к письму
+				body += fmt.Sprintf("К письму прикреплен файл измнений: %s\n", entry.TargetFile)
+				msg.Attachments = append(msg.Attachments, file.Attachment)
+			}
+		}
+	}
+	return body
+}
+
+// Файл изменений: TargetFile содержит подстроку "info"
+func isInfoFile(entry ReleaseData) bool {
+	return strings.Contains(entry.TargetFile, "info")
+}
+
+// Сведения о файле релиза, полученные с сервера до формирования письма
+type releaseFile struct {
+	// Чтение файла изменений с сервера во вложение при отправке письма
+	Stream func(w io.Writer) error
+	// Локальная копия файла изменений, если файл нельзя читать при отправке
+	Attachment string
+	// Размер файла изменений больше smtp.max_attachment_bytes
+	TooLarge int64
+	// Сумма файла изменений не совпала с манифестом при verify_hash_strict
+	HashMismatch bool
+	// Файл изменений не удалось скачать; письмо отправляется без него
+	DownloadFailed bool
+	// Файлы и директории верхнего уровня архива (smtp.list_zip_contents)
+	ZipEntries []string
+}
+
+// Сведения о файлах релизов по TargetFile
+type releaseFiles map[string]releaseFile
+
+// Подготовка файлов изменений и просмотр архивов для писем по groups.
+// Каждый файл обрабатывается один раз, даже если он встречается в нескольких
+// записях. Файл изменений, который не удалось скачать, не прикладывается:
+// иначе отсутствующий на сервере файл задерживал бы уведомление о релизе
+// на каждой проверке.
+func fetchReleaseFiles(run *checkRun, src FileSource, groups []releaseGroup) releaseFiles {
+	files := make(releaseFiles)
+	stream := streamAttachments(run.Config, groups)
+	for _, group := range groups {
+		for _, entry := range group.Data {
+			if _, ok := files[entry.TargetFile]; ok || entry.TargetFile == "" {
+				continue
+			}
+			var file releaseFile
+			if run.SMTP.ListZipContents {
+				file.ZipEntries = zipEntries(run, src, entry)
+			}
+			if isInfoFile(entry) {
+				if size, ok := attachmentTooLarge(run, src, entry.TargetFile); ok {
+					file.TooLarge = size
+				} else if stream && canStream(run.Config, src, entry.TargetFile) {
+					file.Stream = streamAttachment(run, src, entry)
+				} else {
+					local, verified, err := downloadAttachment(run, src, entry)
+					switch {
+					case err != nil:
+						run.log.Error("Failed to download TargetFile, sending without it", "file", entry.TargetFile, "error", err)
+						file.DownloadFailed = true
+					case verified || !run.SMTP.VerifyHashStrict:
+						file.Attachment = local
+					default:
+						file.HashMismatch = true
+					}
+				}
+			}
+			files[entry.TargetFile] = file
+		}
+	}
+	return files
+}
+
+// Тег, коммит и ветка сборки (smtp.show_vcs). Тег и короткий хэш коммита
+// выводятся первыми: по ним разработчики находят сборку.
+func vcsText(entry ReleaseData) string {
+	var text string
+	if entry.Tag != "" {
+		text += fmt.Sprintf("  Тег: %s\n", entry.Tag)
+	}
+	if commit := shortSha(entry); commit != "" {
+		text += fmt.Sprintf("  Коммит: %s\n", commit)
+	}
+	if entry.BranchName != "" {
+		text += fmt.Sprintf("  Ветка: %s\n", entry.BranchName)
+	}
+	return text
+}
+
+// Короткий хэш коммита; если ShortSha не заполнен, он берется из Sha
+func shortSha(entry ReleaseData) string {
+	if entry.ShortSha != "" {
+		return entry.ShortSha
+	}
+	return entry.Sha[:min(len(entry.Sha), 8)]
+}
+
+// Проверка размера файла изменений по smtp.max_attachment_bytes. Если размер
+// узнать не удалось, файл прикладывается.
+func attachmentTooLarge(run *checkRun, src FileSource, remotePath string) (int64, bool) {
+	if run.SMTP.MaxAttachmentBytes <= 0 {
+		return 0, false
+	}
+	size, err := src.Size(remotePath)
+	if err != nil {
+		run.log.Warn("Failed to get attachment size", "file", remotePath, "error", err)
+		return 0, false
+	}
+	if size > run.SMTP.MaxAttachmentBytes {
+		run.log.Warn("Attachment is too large, omitting", "file", remotePath, "size", size, "max", run.SMTP.MaxAttachmentBytes)
+		return size, true
+	}
+	return size, false
+}
+
+// Размер файла для текста письма
+func formatSize(size int64) string {
+	switch {
+	case size >= 1<<20:
+		return fmt.Sprintf("%d MB", size>>20)
+	case size >= 1<<10:
+		return fmt.Sprintf("%d KB", size>>10)
+	default:
+		return fmt.Sprintf("%d B", size)
+	}
+}
+
+// Скачивание файла изменений во временную директорию проверки, когда его
+// нельзя читать с сервера при отправке (streamAttachments, canStream). Файл
+// скачивается один раз, и к письму прикладывается именно эта копия, поэтому
+// при smtp.verify_hash сумма считается по тем же байтам, которые получат
+// адресаты. verified - false только при несовпадении суммы (verifyAttachmentHash).
+func downloadAttachment(run *checkRun, src FileSource, entry ReleaseData) (string, bool, error) {
+	local := filepath.Join(run.tickDir, "attachments", filepath.FromSlash(path.Clean("/"+entry.TargetFile)))
+	if err := os.MkdirAll(filepath.Dir(local), 0o755); err != nil {
+		return "", false, fmt.Errorf("attachment %s: %w", entry.TargetFile, err)
+	}
+	file, err := os.Create(local)
+	if err != nil {
+		return "", false, fmt.Errorf("attachment %s: %w", entry.TargetFile, err)
+	}
+	defer file.Close()
+
+	var w io.Writer = file
+	h := attachmentHash(run, entry)
+	if h != nil {
+		w = io.MultiWriter(file, h)
+	}
+	if _, err := retrieveTo(run.Config, src, entry.TargetFile, w); err != nil {
+		return "", false, fmt.Errorf("attachment %s: %w", entry.TargetFile, err)
+	}
+	if err := file.Close(); err != nil {
+		return "", false, fmt.Errorf("attachment %s: %w", entry.TargetFile, err)
+	}
+	return local, verifyAttachmentHash(run, entry, h), nil
+}
+
+// Файлы изменений читаются с сервера прямо в письмо. Локальная копия нужна,
+// когда байты файла используются до отправки или больше одного раза:
+// проверка суммы при smtp.verify_hash_strict, копия письма в IMAP,
+// несколько писем по маршрутам smtp.routes.
+func streamAttachments(cfg *Config, groups []releaseGroup) bool {
+	return !cfg.SMTP.VerifyHashStrict && cfg.IMAP.Host == "" && len(routeDeliveries(cfg, groups)) <= 1
+}
+
+// Файл можно читать при отправке, если он есть на сервере и не превышает
+// ftp.max_file_bytes. Иначе ошибка чтения сорвала бы отправку письма, поэтому
+// такой файл скачивается заранее и при ошибке не прикладывается.
+func canStream(cfg *Config, src FileSource, remotePath string) bool {
+	size, err := src.Size(remotePath)
+	if err != nil {
+		return false
+	}
+	return cfg.FTP.MaxFileBytes <= 0 || size <= cfg.FTP.MaxFileBytes
+}
+
+// Копирование файла изменений с сервера во вложение при отправке письма.
+// При smtp.verify_hash сумма считается по переданным байтам; несовпадение
+// только записывается в журнал.
+func streamAttachment(run *checkRun, src FileSource, entry ReleaseData) func(w io.Writer) error {
+	return func(w io.Writer) error {
+		h := attachmentHash(run, entry)
+		if h != nil {
+			w = io.MultiWriter(w, h)
+		}
+		if _, err := retrieveTo(run.Config, src, entry.TargetFile, w); err != nil {
+			return fmt.Errorf("attachment %s: %w", entry.TargetFile, err)
+		}
+		verifyAttachmentHash(run, entry, h)
+		return nil
+	}
+}
+
+// Настройка подключения к SMTP-серверу с учетом способа авторизации
+func smtpDialer(cfg *Config, server smtpServer) (*gomail.Dialer, error) {
+	d := gomail.NewDialer(server.host, server.port, cfg.SMTP.From, cfg.SMTP.Password)
+	tlsConfig, err := smtpTLSConfig(cfg, server.host)
+	if err != nil {
+		return nil, err
+	}
+	d.TLSConfig = tlsConfig
+
+	switch cfg.SMTP.Auth {
+	case "":
+		// Механизм выбирает gomail по списку AUTH, объявленному сервером
+	case "none":
+		// Без имени пользователя gomail не выполняет AUTH
+		d.Username = ""
+		d.Password = ""
+	case "plain":
+		d.Auth = smtp.PlainAuth("", cfg.SMTP.From, cfg.SMTP.Password, server.host)
+	case "login":
+		d.Auth = &loginAuth{username: cfg.SMTP.From, password: cfg.SMTP.Password, host: server.host}
+	default:
+		return nil, fmt.Errorf("unsupported smtp auth mode %q", cfg.SMTP.Auth)
+	}
+	return d, nil
+}
+
+// Настройки TLS для SMTP. Сертификат сервера проверяется, если только
+// проверка не отключена явно через smtp.tls_skip_verify (самоподписанные сертификаты).
+func smtpTLSConfig(cfg *Config, host string) (*tls.Config, error) {
+	serverName := cfg.SMTP.TLSServerName
+	if serverName == "" {
+		serverName = host
+	}
+	minVersion, err := tlsVersion(cfg.SMTP.MinTLSVersion)
+	if err != nil {
+		return nil, err
+	}
+	suites, err := cipherSuites(cfg.SMTP.CipherSuites)
+	if err != nil {
+		return nil, err
+	}
+	return &tls.Config{
+		ServerName:         serverName,
+		InsecureSkipVerify: cfg.SMTP.TLSSkipVerify,
+		MinVersion:         minVersion,
+		CipherSuites:       suites,
+	}, nil
+}
+
+// Версия TLS по строке из конфигурации; по умолчанию TLS 1.2
+func tlsVersion(name string) (uint16, error) {
+	switch name {
+	case "", "1.2":
+		return tls.VersionTLS12, nil
+	case "1.3":
+		return tls.VersionTLS13, nil
+	default:
+		return 0, fmt.Errorf("unsupported TLS version %q (expected 1.2 or 1.3)", name)
+	}
+}
+
+// Идентификаторы наборов шифров по именам. Допускаются только наборы, которые
+// Go считает безопасными; наборы TLS 1.3 не настраиваются и отклоняются.
+func cipherSuites(names []string) ([]uint16, error) {
+	if len(names) == 0 {
+		return nil, nil
+	}
+	known := make(map[string]*tls.CipherSuite)
+	for _, suite := range tls.CipherSuites() {
+		known[suite.Name] = suite
+	}
+
+	ids := make([]uint16, 0, len(names))
+	for _, name := range names {
+		suite, ok := known[name]
+		if !ok {
+			return nil, fmt.Errorf("unknown or insecure cipher suite %q", name)
+		}
+		if !slices.Contains(suite.SupportedVersions, tls.VersionTLS12) {
+			return nil, fmt.Errorf("cipher suite %q is TLS 1.3 only and cannot be configured", name)
+		}
+		ids = append(ids, suite.ID)
+	}
+	return ids, nil
+}
+
+// Механизм авторизации LOGIN, который не входит в net/smtp
+type loginAuth struct {
+	username string
+	password string
+	host     string
+}
+
+func (a *loginAuth) Start(server *smtp.ServerInfo) (string, []byte, error) {
+	if !server.TLS && !slices.Contains(server.Auth, "LOGIN") {
+		return "", nil, errors.New("unencrypted connection")
+	}
+	if server.Name != a.host {
+		return "", nil, errors.New("wrong host name")
+	}
+	return "LOGIN", nil, nil
+}
+
+func (a *loginAuth) Next(fromServer []byte, more bool) ([]byte, error) {
+	if !more {
+		return nil, nil
+	}
+
+	switch string(fromServer) {
+	case "Username:":
+		return []byte(a.username), nil
+	case "Password:":
+		return []byte(a.password), nil
+	default:
+		return nil, fmt.Errorf("unexpected server challenge: %s", fromServer)
+	}
+}
+
+// Отображаемое название платформы
+func platformLabel(cfg *Config, platform string) string {
+	if label, ok := mergeLabels(defaultPlatforms, cfg.Platforms)[platform]; ok {
+		return label
+	}
+	return platform
+}
+
+// Отображаемое название папки. Ключ folders совпадает с путем целиком или с его
+// началом до разделителя; из нескольких подходящих выбирается самый длинный.
+// Без подходящего ключа выводится путь как есть.
+func folderLabel(cfg *Config, folder string) string {
+	normalized := normalizeFolder(folder)
+	best, label := "", folder
+	for key, name := range cfg.Folders {
+		key = normalizeFolder(key)
+		if key == "" || (normalized != key && !strings.HasPrefix(normalized, key+"/")) {
+			continue
+		}
+		if len(key) > len(best) {
+			best, label = key, name
+		}
+	}
+	return label
+}
+
+// Путь папки без различий в разделителях и завершающего разделителя
+func normalizeFolder(folder string) string {
+	return strings.TrimRight(strings.ReplaceAll(folder, "\\", "/"), "/")
+}
+
+// Описание файла по имени архива: первое подходящее правило из
+// description_rules, иначе подстрока из descriptions. Если подходят
+// несколько подстрок, выбирается самая длинная.
+func fileDescription(cfg *Config, zipFileName string) string {
+	for _, rule := range cfg.DescriptionRules {
+		// Выражения скомпилированы при загрузке конфигурации (validateConfig)
+		if rule.re != nil && rule.re.MatchString(zipFileName) {
+			return rule.Label
+		}
+	}
+
+	best, description := "", defaultDescription
+	for key, label := range mergeLabels(defaultDescriptions, cfg.Descriptions) {
+		if key == "" || !strings.Contains(zipFileName, key) {
+			continue
+		}
+		if len(key) > len(best) || (len(key) == len(best) && key < best) {
+			best, description = key, label
+		}
+	}
+	return description
+}
+
+// Объединение встроенных подписей с заданными в конфигурации
+func mergeLabels(defaults, overrides map[string]string) map[string]string {
+	labels := make(map[string]string, len(defaults)+len(overrides))
+	for key, label := range defaults {
+		labels[key] = label
+	}
+	for key, label := range overrides {
+		labels[key] = label
+	}
+	return labels
+}
+
+// Формирование HTML-тела письма по шаблону из smtp.template
+func renderHTMLBody(cfg *Config, data emailTemplateData) (string, error) {
+	tmpl, err := template.New(filepath.Base(cfg.SMTP.Template)).Funcs(templateFuncs(cfg)).ParseFiles(cfg.SMTP.Template)
+	if err != nil {
+		return "", fmt.Errorf("failed to parse email template: %w", err)
+	}
+
+	var buf bytes.Buffer
+	err = tmpl.Execute(&buf, data)
+	if err != nil {
+		return "", fmt.Errorf("failed to render email template: %w", err)
+	}
+	return buf.String(), nil
+}
@@ -0,0 +1,380 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"io"
+	"mime"
+	"net"
+	"net/mail"
+	"net/textproto"
+	"strings"
+	"testing"
+	"time"
+
+	"gopkg.in/gomail.v2"
+)
+
+// Номер сборки в теме письма - наибольший TeamcityBuildCounter среди записей,
+// независимо от их порядка
+func TestEmailSubjectBuildCounter(t *testing.T) {
+	config = Config{}
+	config.SMTP.Subject = "Релиз"
+	config.SMTP.SortBy = "none"
+
+	entries := func(counters ...int) []ReleaseData {
+		var data []ReleaseData
+		for _, counter := range counters {
+			data = append(data, ReleaseData{TargetFile: "app.zip", TeamcityBuildCounter: counter})
+		}
+		return data
+	}
+
+	tests := []struct {
+		name   string
+		groups []releaseGroup
+		want   string
+	}{
+		{
+			name:   "single entry",
+			groups: []releaseGroup{{Date: "2024-01-02", Data: entries(7)}},
+			want:   "Релиз - 7  2024-01-02",
+		},
+		{
+			name:   "largest counter first",
+			groups: []releaseGroup{{Date: "2024-01-02", Data: entries(120, 15, 99)}},
+			want:   "Релиз - 120  2024-01-02",
+		},
+		{
+			name:   "largest counter in the middle",
+			groups: []releaseGroup{{Date: "2024-01-02", Data: entries(15, 120, 99)}},
+			want:   "Релиз - 120  2024-01-02",
+		},
+		{
+			name:   "missing counters",
+			groups: []releaseGroup{{Date: "2024-01-02", Data: entries(0, 42, 0)}},
+			want:   "Релиз - 42  2024-01-02",
+		},
+		{
+			name: "digest across dates",
+			groups: []releaseGroup{
+				{Date: "2024-01-02", Data: entries(300, 5)},
+				{Date: "2024-01-03", Data: entries(12)},
+			},
+			want: "Релиз - 300  2024-01-02, 2024-01-03",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			msg, err := buildEmail(testRun(t), []string{"team@example.com"}, tt.groups, nil)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if msg.Subject != tt.want {
+				t.Errorf("subject = %q, want %q", msg.Subject, tt.want)
+			}
+		})
+	}
+}
+
+// Кодировка указана явно в Content-Type текста и в закодированной теме
+func TestComposeMessageCharset(t *testing.T) {
+	const subject = "Версия сборки 1.2"
+	const body = "Версия сборки: 42\n"
+
+	tests := []struct {
+		charset string
+		want    string
+	}{
+		{charset: "", want: "utf-8"},
+		{charset: "UTF-8", want: "utf-8"},
+		{charset: "windows-1251", want: "windows-1251"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.want+"/"+tt.charset, func(t *testing.T) {
+			config = Config{}
+			config.SMTP.Charset = tt.charset
+			want := tt.want
+
+			m, err := composeMessage(&config, emailMessage{
+				From:    "notifier@example.com",
+				To:      []string{"team@example.com"},
+				Subject: subject,
+				Body:    body,
+			})
+			if err != nil {
+				t.Fatal(err)
+			}
+			var raw bytes.Buffer
+			if _, err := m.WriteTo(&raw); err != nil {
+				t.Fatal(err)
+			}
+			parsed, err := mail.ReadMessage(&raw)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			mediaType, params, err := mime.ParseMediaType(parsed.Header.Get("Content-Type"))
+			if err != nil {
+				t.Fatal(err)
+			}
+			if mediaType != "text/plain" || strings.ToLower(params["charset"]) != want {
+				t.Errorf("Content-Type = %q, want text/plain with charset %s", parsed.Header.Get("Content-Type"), want)
+			}
+
+			encoded := parsed.Header.Get("Subject")
+			if !strings.HasPrefix(strings.ToLower(encoded), "=?"+want+"?") {
+				t.Errorf("Subject = %q, want encoded word in %s", encoded, want)
+			}
+			decoder := mime.WordDecoder{CharsetReader: func(name string, input io.Reader) (io.Reader, error) {
+				enc, err := charsetEncoding(name)
+				if err != nil {
+					return nil, err
+				}
+				return enc.NewDecoder().Reader(input), nil
+			}}
+			decoded, err := decoder.DecodeHeader(encoded)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if decoded != subject {
+				t.Errorf("decoded subject = %q, want %q", decoded, subject)
+			}
+		})
+	}
+}
+
+// Файл изменений, который не удалось скачать, не прикладывается,
+// а письмо все равно формируется с пометкой в тексте
+func TestReleaseEmailWithoutDownloadedInfoFile(t *testing.T) {
+	config = Config{}
+	config.SMTP.Subject = "Релиз"
+	run := testRun(t)
+
+	groups := []releaseGroup{{Date: "2024-01-02", Data: []ReleaseData{
+		{TargetFile: "app-info.txt", TeamcityBuildCounter: 7},
+	}}}
+	files := fetchReleaseFiles(run, modTimeSource{}, groups)
+	if !files["app-info.txt"].DownloadFailed {
+		t.Fatalf("failed download is not recorded: %+v", files["app-info.txt"])
+	}
+
+	msg, err := buildEmail(run, []string{"team@example.com"}, groups, files)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(msg.Attachments) != 0 {
+		t.Errorf("attachments = %q, want none", msg.Attachments)
+	}
+	if !strings.Contains(msg.Body, "Файл изменений app-info.txt не приложен (не удалось скачать)") {
+		t.Errorf("body does not mention the missing file:\n%s", msg.Body)
+	}
+}
+
+// Источник с файлами в памяти; retrieved - число чтений файлов
+type memorySource struct {
+	modTimeSource
+	files     map[string]string
+	retrieved *int
+}
+
+func (s memorySource) Retrieve(name string) (io.ReadCloser, error) {
+	content, ok := s.files[name]
+	if !ok {
+		return nil, errors.New("550 no such file")
+	}
+	*s.retrieved++
+	return io.NopCloser(strings.NewReader(content)), nil
+}
+
+func (s memorySource) Size(name string) (int64, error) {
+	content, ok := s.files[name]
+	if !ok {
+		return 0, errors.New("550 no such file")
+	}
+	return int64(len(content)), nil
+}
+
+// Файл изменений читается с сервера при отправке письма, а локальная копия
+// делается, только когда байты нужны заранее или несколько раз
+func TestReleaseFilesStreaming(t *testing.T) {
+	tests := []struct {
+		name   string
+		setup  func()
+		stream bool
+	}{
+		{name: "default", setup: func() {}, stream: true},
+		{name: "verify_hash_strict", setup: func() { config.SMTP.VerifyHashStrict = true }},
+		{name: "imap", setup: func() { config.IMAP.Host = "imap.example.com" }},
+		{name: "routes", setup: func() {
+			config.SMTP.To = []string{"team@example.com"}
+			config.SMTP.Routes = []Route{{To: []string{"qa@example.com"}}}
+		}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			config = Config{}
+			config.SMTP.Subject = "Релиз"
+			tt.setup()
+			run := testRun(t)
+
+			retrieved := 0
+			src := memorySource{files: map[string]string{"app-info.txt": "changes"}, retrieved: &retrieved}
+			groups := []releaseGroup{{Date: "2024-01-02", Data: []ReleaseData{{TargetFile: "app-info.txt"}}}}
+			file := fetchReleaseFiles(run, src, groups)["app-info.txt"]
+			if (file.Stream != nil) != tt.stream || (file.Attachment != "") == tt.stream {
+				t.Fatalf("stream = %t, attachment = %q, want stream %t", file.Stream != nil, file.Attachment, tt.stream)
+			}
+			if !tt.stream {
+				return
+			}
+			if retrieved != 0 {
+				t.Fatalf("file is retrieved %d times before sending", retrieved)
+			}
+
+			msg, err := buildEmail(run, []string{"team@example.com"}, groups, releaseFiles{"app-info.txt": file})
+			if err != nil {
+				t.Fatal(err)
+			}
+			m, err := composeMessage(run.Config, msg)
+			if err != nil {
+				t.Fatal(err)
+			}
+			var raw bytes.Buffer
+			if _, err := m.WriteTo(&raw); err != nil {
+				t.Fatal(err)
+			}
+			if retrieved != 1 || !strings.Contains(raw.String(), `filename="app-info.txt"`) {
+				t.Errorf("attachment is not streamed into the message (retrieved %d times)", retrieved)
+			}
+		})
+	}
+}
+
+// SMTP-сервер для тестов: hang - не отвечать после подключения, иначе
+// принимать письма и передавать их тексты в messages
+func startSMTPServer(t *testing.T, hang bool) (smtpServer, <-chan string) {
+	t.Helper()
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { ln.Close() })
+	messages := make(chan string, 1)
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer conn.Close()
+				if hang {
+					io.Copy(io.Discard, conn)
+					return
+				}
+				tp := textproto.NewConn(conn)
+				tp.PrintfLine("220 test")
+				for {
+					line, err := tp.ReadLine()
+					if err != nil {
+						return
+					}
+					switch cmd := strings.ToUpper(strings.Fields(line + " ")[0]); cmd {
+					case "EHLO", "HELO", "MAIL", "RCPT":
+						tp.PrintfLine("250 ok")
+					case "DATA":
+						tp.PrintfLine("354 go ahead")
+						data, _ := tp.ReadDotBytes()
+						messages <- string(data)
+						tp.PrintfLine("250 queued")
+					case "QUIT":
+						tp.PrintfLine("221 bye")
+						return
+					default:
+						tp.PrintfLine("502 unsupported")
+					}
+				}
+			}()
+		}
+	}()
+	addr := ln.Addr().(*net.TCPAddr)
+	return smtpServer{host: "127.0.0.1", port: addr.Port}, messages
+}
+
+func testMessage(t *testing.T) *gomail.Message {
+	t.Helper()
+	m, err := composeMessage(&config, emailMessage{
+		From:    "notifier@example.com",
+		To:      []string{"team@example.com"},
+		Subject: "Релиз",
+		Body:    "Выложена новая сборка",
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return m
+}
+
+// Письмо передается серверу через соединение с таймаутами
+func TestDialAndSend(t *testing.T) {
+	config = Config{}
+	config.SMTP.Auth = "none"
+	server, messages := startSMTPServer(t, false)
+	d, err := smtpDialer(&config, server)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := dialAndSend(context.Background(), d, testMessage(t), smtpTimeout(&config)); err != nil {
+		t.Fatal(err)
+	}
+	if msg := <-messages; !strings.Contains(msg, "To: team@example.com") {
+		t.Errorf("unexpected message:\n%s", msg)
+	}
+}
+
+// Зависший сервер прерывает отправку по smtp.timeout, а отмена контекста -
+// сразу; в обоих случаях ошибка возвращается после закрытия соединения
+func TestDialAndSendHangingServer(t *testing.T) {
+	tests := []struct {
+		name    string
+		timeout time.Duration
+		cancel  bool
+	}{
+		{name: "timeout", timeout: 100 * time.Millisecond},
+		{name: "cancel", timeout: time.Hour, cancel: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			config = Config{}
+			config.SMTP.Auth = "none"
+			config.SMTP.Timeout = tt.timeout
+			run := testRun(t)
+			server, _ := startSMTPServer(t, true)
+			d, err := smtpDialer(&config, server)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			ctx, cancel := context.WithCancel(context.Background())
+			defer cancel()
+			if tt.cancel {
+				time.AfterFunc(100*time.Millisecond, cancel)
+			}
+			done := make(chan error, 1)
+			go func() { done <- sendWithRetry(ctx, run, d, testMessage(t)) }()
+			select {
+			case err := <-done:
+				if err == nil {
+					t.Fatal("send to a hanging server succeeded")
+				}
+				if tt.cancel && !errors.Is(err, context.Canceled) {
+					t.Errorf("error = %v, want cancellation", err)
+				}
+			case <-time.After(5 * time.Second):
+				t.Fatal("send to a hanging server did not stop")
+			}
+		})
+	}
+}
@@ -1,45 +1,32 @@
 package main
 
 import (
-	"bufio"
-	"crypto/tls"
+	"bytes"
+	"cmp"
+	"context"
 	"encoding/json"
+	"errors"
+	"flag"
 	"fmt"
-	"log"
+	"log/slog"
 	"os"
+	"os/signal"
+	"path"
 	"path/filepath"
-	"regexp"
+	"runtime/debug"
+	"slices"
+	"sort"
 	"strconv"
 	"strings"
+	"sync/atomic"
+	"syscall"
 	"time"
 
 	"github.com/jlaffaye/ftp"
-	"gopkg.in/gomail.v2"
-	"gopkg.in/yaml.v3"
+	"golang.org/x/text/encoding/unicode"
+	"golang.org/x/text/transform"
 )
 
-// Конфигурация приложения
-type Config struct {
-	FTP struct {
-		Server   string `yaml:"server"`
-		User     string `yaml:"user"`
-		Password string `yaml:"password"`
-		Dir      string `yaml:"dir"`
-		Pattern  string `yaml:"pattern"`
-		Period   int    `yaml:"period"`
-	} `yaml:"ftp"`
-
-	SMTP struct {
-		Host     string   `yaml:"host"`
-		Port     string   `yaml:"port"`
-		From     string   `yaml:"from"`
-		Password string   `yaml:"password"`
-		To       []string `yaml:"to"`
-		Subject  string   `yaml:"subject"`
-		Text     string   `yaml:"text"`
-	} `yaml:"smtp"`
-}
-
 type ReleaseData struct {
 	TargetFolder         string    `json:"TargetFolder"`
 	TargetFile           string    `json:"TargetFile"`
@@ -60,323 +47,917 @@ type ReleaseData struct {
 	FullVersion          string    `json:"FullVersion"`
 }
 
-var config Config
+// Версия из числовых полей в виде Major.Minor.Patch.Build; пустая строка,
+// если числовые поля не заполнены. В шаблонах доступна как .SemVer.
+func (d ReleaseData) SemVer() string {
+	if d.Major == 0 && d.Minor == 0 && d.Patch == 0 && d.Build == 0 {
+		return ""
+	}
+	return fmt.Sprintf("%d.%d.%d.%d", d.Major, d.Minor, d.Patch, d.Build)
+}
+
+// Поле Version расходится с числовыми полями. Version без номера сборки
+// (Major.Minor.Patch) расхождением не считается.
+func (d ReleaseData) versionMismatch() bool {
+	semver := d.SemVer()
+	if semver == "" || d.Version == "" {
+		return false
+	}
+	return d.Version != semver && d.Version != fmt.Sprintf("%d.%d.%d", d.Major, d.Minor, d.Patch)
+}
+
+// Версия для уведомлений: при расхождении или пустом Version предпочитается
+// версия из числовых полей
+func (d ReleaseData) displayVersion() string {
+	if d.Version == "" || d.versionMismatch() {
+		return cmp.Or(d.SemVer(), d.Version)
+	}
+	return d.Version
+}
+
+// Версия и коммит сборки, задаются при сборке:
+// go build -ldflags "-X main.version=1.2.3 -X main.commit=abc123"
+var (
+	version = "dev"
+	commit  = ""
+)
+
+// Пробный запуск: письма выводятся в stdout, отметки об отправке не сохраняются
+var dryRun bool
+
+// Повторная отправка файлов за последний период (-backfill): отметки об
+// отправке не учитываются и без -mark не сохраняются, тема письма при prefix
+// начинается с [BACKFILL]
+var backfill struct {
+	window time.Duration
+	mark   bool
+	prefix bool
+}
 
-const sentFilesLog = "sent_files.log"
+// Период -backfill: длительность Go (36h) или число дней (7d)
+func parseBackfillWindow(value string) error {
+	var window time.Duration
+	if days, ok := strings.CutSuffix(value, "d"); ok {
+		n, err := strconv.Atoi(days)
+		if err != nil {
+			return fmt.Errorf("invalid number of days %q", value)
+		}
+		window = time.Duration(n) * 24 * time.Hour
+	} else {
+		d, err := time.ParseDuration(value)
+		if err != nil {
+			return err
+		}
+		window = d
+	}
+	if window <= 0 {
+		return fmt.Errorf("backfill window must be positive")
+	}
+	backfill.window = window
+	return nil
+}
 
 func main() {
+	once := flag.Bool("once", false, "run a single check and exit (exit code 1 if any check or notification failed)")
+	list := flag.Bool("list", false, "print matching files with their sent state and exit, without downloading or sending")
+	showVersion := flag.Bool("version", false, "print version and exit")
+	flag.BoolVar(&dryRun, "dry-run", false, "build emails and print them to stdout without sending or marking files as sent")
+	flag.Func("backfill", "resend notifications for all matching files modified within the window (e.g. 7d or 36h), ignoring the sent log, and exit", parseBackfillWindow)
+	flag.BoolVar(&backfill.mark, "mark", false, "with -backfill, record backfilled files as sent")
+	flag.BoolVar(&backfill.prefix, "backfill-prefix", true, "with -backfill, prefix email subjects with [BACKFILL]")
+	configPath := flag.String("config", "", "path to config file (default $FTPNOTIFIER_CONFIG or config.yaml)")
+	flag.Parse()
+
+	if *showVersion {
+		fmt.Println("ftpnotifier", versionString())
+		return
+	}
+
 	// Загрузка конфигурации
-	loadConfig("config.yaml")
-	var t time.Duration
-	t = time.Duration(config.FTP.Period) * time.Minute
-	// Периодичность выполнения
-	ticker := time.NewTicker(t)
-	defer ticker.Stop()
-
-	for range ticker.C {
-		log.Println("Starting FTP file check...")
-		files, err := getNewFilesFromFTP()
-		if err != nil {
-			log.Printf("Error fetching new files: %v\n", err)
-			continue
+	configFile := resolveConfigPath(*configPath)
+	loadConfig(configFile)
+	if err := setupLogging(); err != nil {
+		fatal("Invalid config", "error", err)
+	}
+
+	// Хранилище отметок об отправленных файлах
+	var err error
+	store, err = openStore()
+	if err != nil {
+		fatal("Failed to open sent files store", "error", err)
+	}
+	defer store.Close()
+
+	// Только просмотр подходящих файлов, состояние не меняется
+	if *list {
+		if err := forEachJob(printMatchingFiles); err != nil {
+			slog.Error("Listing failed", "error", err)
+			store.Close()
+			os.Exit(1)
 		}
+		return
+	}
 
-		if len(files) == 0 {
-			log.Println("No new files to send.")
-			continue
+	// Повторная отправка за период вместо обычной работы
+	if backfill.window > 0 {
+		if err := forEachJob(runCheck); err != nil {
+			slog.Error("Backfill failed", "error", err)
+			store.Close()
+			os.Exit(1)
 		}
+		return
+	}
+	pruneSentFiles()
 
-		// Группировка файлов по дате модификации
-		groupedFiles := groupFilesByDate(files)
+	startHTTPServers()
 
-		for date, fileGroup := range groupedFiles {
-			// Обработка JSON-файлов
-			data, err := processJSONFiles(fileGroup)
-			if err != nil {
-				log.Printf("Error processing JSON files for date %s: %v\n", date, err)
-				continue
-			}
+	// Однократная проверка для запуска из внешнего планировщика
+	if *once {
+		if err := runAllJobs(); err != nil {
+			slog.Error("Check failed", "error", err)
+			store.Close()
+			os.Exit(1)
+		}
+		return
+	}
+
+	// Первая проверка сразу после запуска, далее по расписанию cron
+	// или с фиксированным интервалом
+	stop := startChecks(true)
+
+	// По SIGHUP конфигурация перечитывается; при изменении расписания
+	// или периода проверки перезапускаются после завершения текущей
+	reload := make(chan os.Signal, 1)
+	signal.Notify(reload, syscall.SIGHUP)
+	for range reload {
+		schedules := jobSchedules()
+		if err := reloadConfig(configFile); err != nil {
+			slog.Error("Config reload failed, keeping previous config", "path", configFile, "error", err)
+			continue
+		}
+		if !slices.Equal(jobSchedules(), schedules) {
+			stop()
+			stop = startChecks(false)
+		}
+	}
+}
 
-			// Отправка письма
-			err = sendEmailWithJSONData(data, date)
-			if err != nil {
-				log.Printf("Error sending email for date %s: %v\n", date, err)
-			} else {
-				log.Printf("Email with data for date %s sent successfully!\n", date)
-				markFilesAsSent(fileGroup)
+// Версия сборки; если коммит не задан при сборке, берется из данных VCS
+func versionString() string {
+	rev := commit
+	if rev == "" {
+		if info, ok := debug.ReadBuildInfo(); ok {
+			for _, setting := range info.Settings {
+				if setting.Key == "vcs.revision" {
+					rev = setting.Value
+				}
 			}
 		}
 	}
+	if rev == "" {
+		return version
+	}
+	return fmt.Sprintf("%s (%s)", version, rev)
 }
 
-// Загрузка конфигурации из YAML-файла
-func loadConfig(filename string) {
-	file, err := os.ReadFile(filename)
+// Одна проверка FTP: поиск новых файлов, обработка и отправка писем.
+// Все операции выполняются через одно соединение, которое закрывается в конце.
+// Возвращает ошибку, если не удалось подключиться или обработать хотя бы одну группу.
+func runCheck(run *checkRun) (err error) {
+	run.log.Info("Starting FTP file check")
+	defer func() {
+		run.stats.log(run.log, err)
+		writeReport(run, err)
+	}()
+	defer func() {
+		if err == nil {
+			appMetrics.tickSucceeded(run.Name)
+		} else {
+			appMetrics.tickFailed(run.Name)
+		}
+	}()
+	pruneSentFiles()
+
+	// Общий срок проверки: зависшая операция прерывается, и следующая
+	// проверка может начаться
+	ctx := context.Background()
+	if run.TickTimeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, run.TickTimeout)
+		defer cancel()
+	}
+
+	src, err := openSource(ctx, run)
 	if err != nil {
-		log.Fatalf("Failed to load config file: %v", err)
+		appMetrics.ftpErrors.Add(1)
+		return fmt.Errorf("error connecting to FTP: %w", err)
 	}
+	defer src.Close()
 
-	err = yaml.Unmarshal(file, &config)
+	// Все скачанные за проверку файлы складываются в отдельную директорию
+	if run.DownloadDir != "" {
+		if err := os.MkdirAll(run.DownloadDir, 0755); err != nil {
+			return fmt.Errorf("failed to create download directory: %w", err)
+		}
+	}
+	run.tickDir, err = os.MkdirTemp(run.DownloadDir, "ftpnotifier-")
 	if err != nil {
-		log.Fatalf("Failed to parse config file: %v", err)
+		return fmt.Errorf("failed to create temporary directory: %w", err)
 	}
-}
+	defer func() {
+		if err := os.RemoveAll(run.tickDir); err != nil {
+			run.log.Warn("Failed to remove temporary directory", "path", run.tickDir, "error", err)
+		}
+	}()
 
-// Получение новых файлов с FTP-сервера
-func getNewFilesFromFTP() ([]ftp.Entry, error) {
-	// Подключение к FTP-серверу
-	conn, err := ftp.Dial(config.FTP.Server+":21", ftp.DialWithTimeout(5*time.Second))
+	files, err := getNewFilesFromFTP(run, src)
 	if err != nil {
-		return nil, fmt.Errorf("failed to connect to FTP server: %w", err)
+		appMetrics.ftpErrors.Add(1)
+		return fmt.Errorf("error fetching new files: %w", err)
+	}
+
+	appMetrics.filesFound.Add(int64(len(files)))
+	run.stats.files.Store(int64(len(files)))
+	for _, file := range files {
+		run.stats.report.files = append(run.stats.report.files, file.Name)
+	}
+	if len(files) == 0 {
+		run.log.Info("No new files to send")
+		return nil
 	}
-	defer conn.Quit()
 
-	// Авторизация
-	err = conn.Login(config.FTP.User, config.FTP.Password)
+	// Группировка файлов по дате модификации или по версии релиза
+	groupedFiles, err := groupFiles(ctx, run, src, files)
 	if err != nil {
-		return nil, fmt.Errorf("failed to login to FTP server: %w", err)
+		appMetrics.ftpErrors.Add(1)
+		return fmt.Errorf("error grouping files: %w", err)
 	}
+	run.stats.groups.Store(int64(len(groupedFiles)))
 
-	// Переход в директорию
-	err = conn.ChangeDir(config.FTP.Dir)
+	// Для сводного письма группы обрабатываются по возрастанию даты
+	keys := make([]string, 0, len(groupedFiles))
+	for key := range groupedFiles {
+		keys = append(keys, key)
+	}
+	slices.SortFunc(keys, func(a, b string) int {
+		return cmp.Or(
+			cmp.Compare(groupDate(run, groupedFiles[a]), groupDate(run, groupedFiles[b])),
+			cmp.Compare(a, b),
+		)
+	})
+
+	run.stats.report.groups = keys
+
+	// Группы независимы и при groups_concurrency > 1 обрабатываются параллельно;
+	// результаты собираются по индексу, чтобы порядок дат сохранялся
+	results := make([]groupResult, len(keys))
+	// Отметки отправленных групп копятся за проверку и записываются одной
+	// операцией в конце, в том числе при сбое части групп
+	var sent []sentRecord
+	defer func() {
+		if dryRun || highwaterMode() {
+			return
+		}
+		for _, result := range results {
+			if !result.failed && !result.pending {
+				sent = append(sent, result.records...)
+			}
+		}
+		markFilesAsSent(sent)
+	}()
+	err = parallelWithSources(ctx, run, src, run.GroupsConcurrency, len(keys), func(conn FileSource, i int) error {
+		results[i] = processGroup(ctx, run, conn, groupedFiles[keys[i]])
+		return nil
+	})
+	if err != nil {
+		appMetrics.ftpErrors.Add(1)
+		return err
+	}
+
+	failed := 0
+	var digest []releaseGroup
+	var digestRecords []sentRecord
+	for _, result := range results {
+		if result.failed {
+			failed++
+		}
+		if result.pending {
+			digest = append(digest, result.group)
+			digestRecords = append(digestRecords, result.records...)
+		}
+	}
+
+	// Одно сводное письмо по всем датам
+	if len(digest) > 0 {
+		err = notify(ctx, run, src, digest)
+		if err != nil {
+			run.log.Error("Error sending digest notification", "error", err)
+			appMetrics.emailsFailed.Add(1)
+			failed += len(digest)
+			run.stats.errors.Add(1)
+			run.stats.report.addError(fmt.Errorf("digest notification: %w", err))
+		} else {
+			run.log.Info("Digest notification sent", "dates", len(digest), "count", len(digestRecords))
+			run.stats.emails.Add(1)
+			if !dryRun {
+				appMetrics.emailsSent.Add(1)
+				sent = append(sent, digestRecords...)
+			}
+		}
+	}
+
+	if failed > 0 {
+		return fmt.Errorf("%d of %d groups failed", failed, len(groupedFiles))
+	}
+
+	// Отметка highwater сдвигается только после успешной отправки всех групп:
+	// иначе файлы неудачной группы оказались бы старше отметки и были бы
+	// потеряны. Успешные группы при сбое будут отправлены повторно.
+	if highwaterMode() && !dryRun {
+		var records []sentRecord
+		for _, result := range results {
+			records = append(records, result.records...)
+		}
+		markFilesAsSent(records)
+	}
+	return nil
+}
+
+// Результат обработки группы файлов за одну дату
+type groupResult struct {
+	group   releaseGroup
+	records []sentRecord
+	// Обработка или отправка не удалась
+	failed bool
+	// Группа ждет сводного письма (smtp.digest)
+	pending bool
+}
+
+// Обработка группы файлов за одну дату: разбор JSON и отправка уведомления.
+// При smtp.digest уведомление не отправляется, группа возвращается для сводного письма.
+func processGroup(ctx context.Context, run *checkRun, src FileSource, fileGroup []ftp.Entry) groupResult {
+	date := groupDate(run, fileGroup)
+
+	// Обработка JSON-файлов
+	data, records, err := processJSONFiles(ctx, run, src, fileGroup)
 	if err != nil {
-		return nil, fmt.Errorf("failed to change directory: %w", err)
+		run.log.Error("Error processing JSON files", "date", date, "error", err)
+		appMetrics.ftpErrors.Add(1)
+		run.stats.errors.Add(1)
+		run.stats.report.addError(fmt.Errorf("processing %s: %w", date, err))
+		return groupResult{failed: true}
+	}
+	if len(records) == 0 {
+		run.log.Info("No changed files", "date", date)
+		return groupResult{}
+	}
+	data = excludeReleaseData(run, data)
+	if len(data) == 0 {
+		run.log.Info("All entries are excluded, skipping notification", "date", date, "count", len(records))
+		// Файлы отмечаются в конце проверки, чтобы не разбирать их заново
+		return groupResult{records: records}
+	}
+
+	group := releaseGroup{Date: date, Data: data}
+	if run.SMTP.AttachSourceJSON {
+		// Исходные JSON-файлы уже скачаны при обработке
+		for _, record := range records {
+			group.Sources = append(group.Sources, localPath(run, record.Path))
+		}
+	}
+
+	if run.SMTP.Digest {
+		return groupResult{group: group, records: records, pending: true}
 	}
 
+	// Отправка уведомлений
+	err = notify(ctx, run, src, []releaseGroup{group})
+	if err != nil {
+		run.log.Error("Error sending notification", "date", date, "error", err)
+		appMetrics.emailsFailed.Add(1)
+		run.stats.errors.Add(1)
+		run.stats.report.addError(fmt.Errorf("notification for %s: %w", date, err))
+		return groupResult{failed: true}
+	}
+
+	run.log.Info("Notification sent", "date", date, "count", len(records))
+	run.stats.emails.Add(1)
+	if !dryRun {
+		appMetrics.emailsSent.Add(1)
+	}
+	// Файлы отмечаются в конце проверки (runCheck)
+	return groupResult{group: group, records: records}
+}
+
+// Получение новых файлов с FTP-сервера
+func getNewFilesFromFTP(run *checkRun, src FileSource) ([]ftp.Entry, error) {
 	// Получение списка файлов
-	files, err := conn.List("")
+	files, err := listFiles(run, src)
 	if err != nil {
 		return nil, fmt.Errorf("failed to list files: %w", err)
 	}
+	run.state.pruneModTimes(files)
 
-	// Фильтрация файлов по маске и проверка на отправку
+	// Фильтрация файлов по маске и проверка на отправку.
+	// При дедупликации по содержимому проверка выполняется после скачивания.
+	// Файлы старше срока хранения отметок пропускаются, иначе после очистки
+	// журнала они были бы отправлены повторно.
 	var filteredFiles []ftp.Entry
-	pattern := regexp.MustCompile(strings.ReplaceAll(config.FTP.Pattern, "*", ".*"))
+	filter, err := newFileFilter(run.Config)
+	if err != nil {
+		return nil, err
+	}
+	cutoff := retentionCutoff()
+	minAge := time.Duration(run.FTP.MinAgeSeconds) * time.Second
+	seen := make(map[string]ftp.Entry)
 	for _, file := range files {
-		if pattern.MatchString(file.Name) && !isFileAlreadySent(*file) {
-			log.Printf("Found new file: %s (Modified: %s)", file.Name, file.Time.Format(time.RFC3339))
+		// Директории и ссылки не скачиваются, даже если имя подходит под маску
+		if file.Type != ftp.EntryTypeFile {
+			continue
+		}
+		if !filter.Match(path.Base(file.Name)) {
+			continue
+		}
+		file.Time = preciseModTime(run, src, file)
+		if cutoff != "" && file.Time.Format("2006-01-02") < cutoff {
+			continue
+		}
+		seen[file.Name] = *file
+		if minAge > 0 && time.Since(file.Time) < minAge {
+			run.log.Debug("File was modified recently, postponing", "file", file.Name, "modified", file.Time.Format(time.RFC3339))
+			continue
+		}
+		if backfill.window > 0 {
+			if time.Since(file.Time) <= backfill.window {
+				run.log.Info("Found file to backfill", "file", file.Name, "modified", file.Time.Format(time.RFC3339))
+				filteredFiles = append(filteredFiles, *file)
+			}
+			continue
+		}
+		if dedupByHash() || !isFileAlreadySent(newSentRecord(run, *file, nil)) {
+			run.log.Info("Found new file", "file", file.Name, "modified", file.Time.Format(time.RFC3339))
 			filteredFiles = append(filteredFiles, *file)
 		}
 	}
+	if run.FTP.WarnMissed {
+		warnMissedFiles(run, seen)
+	}
 
 	return filteredFiles, nil
 }
 
+// Вывод подходящих под маски файлов с временем изменения и состоянием (-list):
+// sent - уже отправлен, new - будет отправлен, recent - отложен по min_age_seconds,
+// expired - старше срока хранения отметок
+func printMatchingFiles(run *checkRun) error {
+	src, err := openSource(context.Background(), run)
+	if err != nil {
+		return fmt.Errorf("error connecting to FTP: %w", err)
+	}
+	defer src.Close()
+
+	files, err := listFiles(run, src)
+	if err != nil {
+		return fmt.Errorf("failed to list files: %w", err)
+	}
+	filter, err := newFileFilter(run.Config)
+	if err != nil {
+		return err
+	}
+
+	cutoff := retentionCutoff()
+	minAge := time.Duration(run.FTP.MinAgeSeconds) * time.Second
+	for _, file := range files {
+		if file.Type != ftp.EntryTypeFile || !filter.Match(path.Base(file.Name)) {
+			continue
+		}
+		file.Time = preciseModTime(run, src, file)
+
+		state := "new"
+		switch {
+		case cutoff != "" && file.Time.Format("2006-01-02") < cutoff:
+			state = "expired"
+		case isFileAlreadySent(newSentRecord(run, *file, nil)):
+			state = "sent"
+		case minAge > 0 && time.Since(file.Time) < minAge:
+			state = "recent"
+		}
+		fmt.Printf("%s  %-7s  %s\n", file.Time.In(run.location).Format(time.RFC3339), state, recordName(run.Name, file.Name))
+	}
+	return nil
+}
+
+// Предупреждение о файлах, которые были в списке на прошлой проверке, пропали
+// из него и так и не были отправлены: сервер удаляет их быстрее, чем их
+// успевают обработать
+func warnMissedFiles(run *checkRun, seen map[string]ftp.Entry) {
+	previous := run.state.lastSeen
+	run.state.lastSeen = seen
+	for name, file := range previous {
+		if _, ok := seen[name]; ok {
+			continue
+		}
+		if !isFileAlreadySent(newSentRecord(run, file, nil)) {
+			run.log.Warn("File disappeared from the server before it was sent, the check period may be too long",
+				"file", name, "modified", file.Time.Format(time.RFC3339))
+		}
+	}
+}
+
+// Точность времени изменения файла, от которой зависит ключ отметки
+type timePrecision int
+
+const (
+	// Точное время из MDTM
+	timeExact timePrecision = iota
+	// Время из списка LIST: с точностью до минуты, а для файлов старше
+	// полугода - только дата, поэтому в отметке сохраняется только дата
+	timeListed
+	// Сервер не сообщает время: в отметке вместо даты размер файла
+	timeUnknown
+)
+
+// Время изменения файла, уже полученное с сервера
+type fileModTime struct {
+	time      time.Time
+	precision timePrecision
+}
+
+// Ключ кэша времени изменения: версия файла по имени, размеру и времени из списка
+func modTimeKey(file *ftp.Entry) string {
+	return fmt.Sprintf("%s|%d|%d", file.Name, file.Size, file.Time.Unix())
+}
+
+// Удаление сведений о файлах, которых нет в новом списке files: удаленных
+// с сервера и прежних версий измененных файлов. Иначе кэши росли бы
+// с каждой выложенной сборкой.
+func (s *jobState) pruneModTimes(files []*ftp.Entry) {
+	keys := make(map[string]bool, len(files))
+	names := make(map[string]bool, len(files))
+	for _, file := range files {
+		keys[modTimeKey(file)] = true
+		names[file.Name] = true
+	}
+	for key := range s.modTimes {
+		if !keys[key] {
+			delete(s.modTimes, key)
+		}
+	}
+	for name := range s.precision {
+		if !names[name] {
+			delete(s.precision, name)
+		}
+	}
+}
+
+// Точное время изменения файла. В списке LIST время бывает с точностью до минуты,
+// а для старых файлов - только дата, поэтому оно запрашивается отдельно (MDTM)
+// один раз для каждой версии файла. Если сервер не поддерживает запрос,
+// используется время из списка.
+//
+// Некоторые серверы не сообщают время вовсе (нулевое время и в списке, и в
+// MDTM). Тогда для группировки используется время, когда файл был впервые
+// замечен, а отметка файла строится по имени и размеру (newSentRecord), чтобы
+// не зависеть от этого времени после перезапуска.
+func preciseModTime(run *checkRun, src FileSource, file *ftp.Entry) time.Time {
+	name := file.Name
+	key := modTimeKey(file)
+	if cached, ok := run.state.modTimes[key]; ok {
+		run.state.precision[name] = cached.precision
+		return cached.time
+	}
+	modTime := fileModTime{precision: timeExact}
+	t, err := src.ModTime(file.Name)
+	if err != nil {
+		if !errors.Is(err, errors.ErrUnsupported) {
+			run.log.Warn("Failed to get file modification time", "file", file.Name, "error", err)
+		}
+		if !file.Time.IsZero() {
+			run.state.precision[name] = timeListed
+			return file.Time
+		}
+		t = file.Time
+	}
+	modTime.time = t
+	if t.IsZero() {
+		modTime = fileModTime{time: time.Now().Truncate(time.Second), precision: timeUnknown}
+		run.log.Warn("Server reported no modification time, using the time the file was first seen for grouping",
+			"file", file.Name, "time", modTime.time.Format(time.RFC3339))
+	}
+	run.state.modTimes[key] = modTime
+	run.state.precision[name] = modTime.precision
+	return modTime.time
+}
+
+// Группировка новых файлов по настройке grouping
+func groupFiles(ctx context.Context, run *checkRun, src FileSource, files []ftp.Entry) (map[string][]ftp.Entry, error) {
+	if run.Grouping != "version" {
+		return groupFilesByDate(run, files), nil
+	}
+	// Версия известна только из содержимого, поэтому файлы скачиваются до группировки
+	if err := downloadFiles(ctx, run, src, files); err != nil {
+		return nil, err
+	}
+	return groupFilesByVersion(run, files), nil
+}
+
 // Группировка файлов по дате модификации
-func groupFilesByDate(files []ftp.Entry) map[string][]ftp.Entry {
+func groupFilesByDate(run *checkRun, files []ftp.Entry) map[string][]ftp.Entry {
 	groupedFiles := make(map[string][]ftp.Entry)
 
 	for _, file := range files {
-		date := extractDateFromFTPFile(file)
-		log.Printf("Grouping file %s by date: %s", file.Name, date)
+		date := extractDateFromFTPFile(run, file)
+		run.log.Debug("Grouping file by date", "file", file.Name, "date", date)
 		groupedFiles[date] = append(groupedFiles[date], file)
 	}
 	return groupedFiles
 }
 
+// Группировка скачанных файлов по версии релиза, чтобы все артефакты одного
+// релиза попали в одно письмо независимо от времени загрузки. Файлы без версии
+// или с ошибкой разбора группируются по дате.
+func groupFilesByVersion(run *checkRun, files []ftp.Entry) map[string][]ftp.Entry {
+	groupedFiles := make(map[string][]ftp.Entry)
+
+	for _, file := range files {
+		key := releaseVersion(run, file)
+		if key == "" {
+			key = extractDateFromFTPFile(run, file)
+			run.log.Warn("File has no release version, grouping by date", "file", file.Name, "date", key)
+		}
+		run.log.Debug("Grouping file by version", "file", file.Name, "version", key)
+		groupedFiles[key] = append(groupedFiles[key], file)
+	}
+	return groupedFiles
+}
+
+// Версия релиза из скачанного JSON-файла: FullVersion, а если оно пусто - Version
+// первой записи; пустая строка, если файл не удалось прочитать
+func releaseVersion(run *checkRun, file ftp.Entry) string {
+	content, err := os.ReadFile(localPath(run, file.Name))
+	if err != nil {
+		return ""
+	}
+	data, err := parseReleaseData(content)
+	if err != nil || len(data) == 0 {
+		return ""
+	}
+	return cmp.Or(data[0].FullVersion, data[0].Version)
+}
+
+// Дата группы для письма - наиболее поздняя дата изменения ее файлов
+func groupDate(run *checkRun, files []ftp.Entry) string {
+	var date string
+	for _, file := range files {
+		date = max(date, extractDateFromFTPFile(run, file))
+	}
+	return date
+}
+
 // Извлечение даты модификации файла
-func extractDateFromFTPFile(file ftp.Entry) string {
-	// Используем время модификации файла
-	modTime := file.Time
+func extractDateFromFTPFile(run *checkRun, file ftp.Entry) string {
+	// Используем время модификации файла в настроенном часовом поясе
+	modTime := file.Time.In(run.location)
 
 	// Форматируем дату в формат YYYYMMDD
 	return modTime.Format("2006-01-02")
 }
 
-// Обработка JSON-файлов
-func processJSONFiles(files []ftp.Entry) ([]ReleaseData, error) {
+// Обработка JSON-файлов. Возвращает данные и отметки только по новым файлам:
+// при дедупликации по содержимому уже отправленные файлы пропускаются.
+func processJSONFiles(ctx context.Context, run *checkRun, src FileSource, files []ftp.Entry) ([]ReleaseData, []sentRecord, error) {
 	var allData []ReleaseData
+	var records []sentRecord
+
+	// Сначала все файлы скачиваются (возможно, параллельно), затем
+	// разбираются по порядку, чтобы результат не зависел от порядка загрузки
+	// При группировке по версии файлы уже скачаны
+	if run.Grouping != "version" {
+		if err := downloadFiles(ctx, run, src, files); err != nil {
+			return nil, nil, err
+		}
+	}
 
 	for _, file := range files {
-		// Скачиваем файл
-		filePath := filepath.Join(os.TempDir(), file.Name)
-		err := downloadFileFromFTP(file.Name, filePath)
+		// Читаем содержимое файла
+		content, err := os.ReadFile(localPath(run, file.Name))
 		if err != nil {
-			return nil, fmt.Errorf("failed to download file %s: %w", file.Name, err)
+			return nil, nil, fmt.Errorf("failed to read file %s: %w", file.Name, err)
 		}
 
-		// Читаем содержимое файла
-		content, err := os.ReadFile(filePath)
-		if err != nil {
-			return nil, fmt.Errorf("failed to read file %s: %w", file.Name, err)
+		record := newSentRecord(run, file, content)
+		if dedupByHash() && backfill.window == 0 && isFileAlreadySent(record) {
+			run.log.Info("File is unchanged since it was sent, skipping", "file", file.Name)
+			continue
 		}
 
-		// Парсим JSON как массив структур
-		var jsonData []ReleaseData
-		err = json.Unmarshal(content, &jsonData)
+		jsonData, err := parseReleaseData(content)
 		if err != nil {
-			return nil, fmt.Errorf("failed to parse JSON from file %s: %w", file.Name, err)
+			return nil, nil, fmt.Errorf("failed to parse JSON from file %s: %w", file.Name, err)
 		}
 
+		jsonData = dedupReleaseData(run, file.Name, jsonData)
+		warnMissingFields(run, file.Name, jsonData)
+		warnVersionMismatch(run, file.Name, jsonData)
+
 		// Добавляем данные из текущего файла в общий массив
 		allData = append(allData, jsonData...)
+		records = append(records, record)
 	}
 
-	return allData, nil
+	return allData, records, nil
 }
 
-// Скачивание файла с FTP
-func downloadFileFromFTP(remotePath, localPath string) error {
-	conn, err := ftp.Dial(config.FTP.Server+":21", ftp.DialWithTimeout(30*time.Second))
+// Разбор JSON с релизами: массив объектов или один объект
+func parseReleaseData(content []byte) ([]ReleaseData, error) {
+	content, err := decodeManifest(content)
 	if err != nil {
-		return fmt.Errorf("failed to connect to FTP server: %w", err)
+		return nil, err
 	}
-	defer conn.Quit()
-
-	err = conn.Login(config.FTP.User, config.FTP.Password)
-	if err != nil {
-		return fmt.Errorf("failed to login to FTP server: %w", err)
+	trimmed := bytes.TrimLeft(content, " \t\r\n")
+	if len(trimmed) > 0 && trimmed[0] == '{' {
+		var entry ReleaseData
+		if err := json.Unmarshal(trimmed, &entry); err != nil {
+			return nil, err
+		}
+		return []ReleaseData{entry}, nil
 	}
 
-	err = conn.ChangeDir(config.FTP.Dir)
-	if err != nil {
-		return fmt.Errorf("failed to change directory: %w", err)
+	var data []ReleaseData
+	if err := json.Unmarshal(trimmed, &data); err != nil {
+		return nil, err
 	}
+	return data, nil
+}
 
-	file, err := os.Create(localPath)
+// Перекодирование манифеста в UTF-8: кодировка определяется по BOM
+// (UTF-8, UTF-16LE или UTF-16BE), без BOM содержимое считается UTF-8
+func decodeManifest(content []byte) ([]byte, error) {
+	decoder := unicode.BOMOverride(unicode.UTF8.NewDecoder())
+	decoded, _, err := transform.Bytes(decoder, content)
 	if err != nil {
-		return fmt.Errorf("failed to create local file: %w", err)
+		return nil, fmt.Errorf("failed to decode file: %w", err)
 	}
-	defer file.Close()
+	return decoded, nil
+}
 
-	reader, err := conn.Retr(remotePath)
-	if err != nil {
-		return fmt.Errorf("failed to retrieve file: %w", err)
+// Удаление записей по exclude_platforms и exclude_zip_substrings
+func excludeReleaseData(run *checkRun, data []ReleaseData) []ReleaseData {
+	if len(run.ExcludePlatforms) == 0 && len(run.ExcludeZipSubstrings) == 0 {
+		return data
+	}
+	kept := make([]ReleaseData, 0, len(data))
+	for _, entry := range data {
+		if isExcluded(run, entry) {
+			run.log.Debug("Excluding entry", "zip", entry.ZipFileName, "platform", entry.Platform)
+			continue
+		}
+		kept = append(kept, entry)
 	}
-	defer reader.Close()
+	return kept
+}
 
-	_, err = file.ReadFrom(reader)
-	if err != nil {
-		return fmt.Errorf("failed to write file content: %w", err)
+func isExcluded(run *checkRun, entry ReleaseData) bool {
+	for _, platform := range run.ExcludePlatforms {
+		if strings.EqualFold(entry.Platform, platform) {
+			return true
+		}
+	}
+	zipName := strings.ToLower(entry.ZipFileName)
+	for _, substring := range run.ExcludeZipSubstrings {
+		if substring != "" && strings.Contains(zipName, strings.ToLower(substring)) {
+			return true
+		}
 	}
+	return false
+}
 
-	return nil
+// Удаление повторов одного артефакта (ZipFileName и Hash) в манифесте
+func dedupReleaseData(run *checkRun, fileName string, data []ReleaseData) []ReleaseData {
+	type key struct{ zip, hash string }
+	seen := make(map[key]bool, len(data))
+	unique := make([]ReleaseData, 0, len(data))
+	for _, entry := range data {
+		k := key{entry.ZipFileName, entry.Hash}
+		if seen[k] {
+			continue
+		}
+		seen[k] = true
+		unique = append(unique, entry)
+	}
+	if duplicates := len(data) - len(unique); duplicates > 0 {
+		run.log.Warn("Collapsed duplicate release entries", "file", fileName, "count", duplicates)
+	}
+	return unique
 }
 
-// Отправка письма с данными из JSON
-func sendEmailWithJSONData(data []ReleaseData, date string) error {
-	// Создание тела письма
-	body := fmt.Sprintf(config.SMTP.Text+" от %s\n", date)
-	var miniVersion = 0
+// Заглушки для обязательных полей записи о релизе, если поле пустое
+var fieldPlaceholders = map[string]string{
+	"TargetFile":  "<no file>",
+	"ZipFileName": "<no archive>",
+	"Platform":    "<no platform>",
+	"Version":     "<no version>",
+}
 
+// Предупреждение о записях без обязательных полей
+func warnMissingFields(run *checkRun, fileName string, data []ReleaseData) {
 	for i, entry := range data {
-		var plat string
-		switch entry.Platform {
-		case "none":
-			plat = "Не подразумевается"
-		default:
-			plat = entry.Platform
-		}
-		var description string
-		switch {
-		case strings.Contains(entry.ZipFileName, "info"):
-			description = "Информация об изменениях"
-		case strings.Contains(entry.ZipFileName, "web"):
-			description = "Веб-клиент"
-		case strings.Contains(entry.ZipFileName, "any-cpu"):
-			description = "Универсальная сборка для win, mac, debian (требуется .net)"
-		default:
-			description = "Сервисы"
-		}
-
-		body += fmt.Sprintf("  Файл %d:\n", i+1)
-		body += fmt.Sprintf("  Описание: %s\n", description)
-		body += fmt.Sprintf("  Папка файла: %s\n", entry.TargetFolder)
-		body += fmt.Sprintf("  Файл: %s\n", entry.TargetFile)
-		body += fmt.Sprintf("  Имя архива: %s\n", entry.ZipFileName)
-		body += fmt.Sprintf("  Платформа: %s\n", plat)
-		body += fmt.Sprintf("  Версия: %s\n", entry.Version)
-		body += fmt.Sprintf("  Дата: %s\n", entry.When.Format(time.RFC3339))
-		body += fmt.Sprintf("  Версия сборки: %d\n", entry.TeamcityBuildCounter)
-		body += "\n"
-		miniVersion = entry.TeamcityBuildCounter
-
-		// Проверяем, содержит ли TargetFile подстроку "info"
-		if strings.Contains(entry.TargetFile, "info") {
-
-			// Скачиваем файл
-			localFilePath := filepath.Join(os.TempDir(), filepath.Base(entry.TargetFile))
-			err := downloadFileFromFTP(entry.TargetFile, localFilePath)
-			if err != nil {
-				log.Printf("Failed to download TargetFile %s: %v", entry.TargetFile, err)
-				continue
+		var missing []string
+		for field, value := range map[string]string{
+			"TargetFile":  entry.TargetFile,
+			"ZipFileName": entry.ZipFileName,
+			"Platform":    entry.Platform,
+			"Version":     entry.Version,
+		} {
+			if value == "" {
+				missing = append(missing, field)
 			}
-
-			// Прикрепляем файл к письму
-			body += fmt.Sprintf("К письму прикреплен файл измнений: %s\n", entry.TargetFile)
+		}
+		if len(missing) > 0 {
+			sort.Strings(missing)
+			run.log.Warn("Release entry is missing fields", "file", fileName, "entry", i+1, "fields", missing)
 		}
 	}
+}
 
-	// Создание нового письма
-	m := gomail.NewMessage()
-	m.SetHeader("From", config.SMTP.From)
-	m.SetHeader("To", config.SMTP.To...)
-	m.SetHeader("Subject", fmt.Sprintf("%s - %d  %s", config.SMTP.Subject, miniVersion, date))
-	m.SetBody("text/plain", body)
-
-	// Добавляем вложения
-	for _, entry := range data {
-		if strings.Contains(entry.TargetFile, "info") {
-			// Скачиваем файл
-			localFilePath := filepath.Join(os.TempDir(), filepath.Base(entry.TargetFile))
-			err := downloadFileFromFTP(entry.TargetFile, localFilePath)
-			if err != nil {
-				log.Printf("Failed to download TargetFile %s: %v", entry.TargetFile, err)
-				continue
-			}
-
-			// Добавляем файл как вложение
-			m.Attach(localFilePath)
+// Предупреждение о записях, в которых Version расходится с Major/Minor/Patch/Build
+func warnVersionMismatch(run *checkRun, fileName string, data []ReleaseData) {
+	for i, entry := range data {
+		if entry.versionMismatch() {
+			run.log.Warn("Release version does not match its numeric fields, using the composed version",
+				"file", fileName, "entry", i+1, "version", entry.Version, "composed", entry.SemVer())
 		}
 	}
-	sp, _ := strconv.Atoi(config.SMTP.Port)
-	// Настройка SMTP-сервера
-	d := gomail.NewDialer(config.SMTP.Host, sp, config.SMTP.From, config.SMTP.Password)
-	d.TLSConfig = &tls.Config{InsecureSkipVerify: true} // Отключаем проверку сертификата
+}
 
-	// Отправка письма
-	if err := d.DialAndSend(m); err != nil {
-		return fmt.Errorf("failed to send email: %w", err)
+// Значение поля для письма или заглушка, если поле пустое
+func fieldOrPlaceholder(value, field string) string {
+	if value != "" {
+		return value
 	}
-	return nil
+	return fieldPlaceholders[field]
 }
 
-// Маркировка файлов как отправленных
-func markFilesAsSent(files []ftp.Entry) {
-	file, err := os.OpenFile(sentFilesLog, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0644)
-	if err != nil {
-		log.Printf("Failed to open sent files log: %v\n", err)
-		return
-	}
-	defer file.Close()
+// Итоги текущей проверки для сводной строки в логе. Счетчики атомарные:
+// группы и загрузки обрабатываются параллельно.
+type tickStats struct {
+	start  time.Time
+	files  atomic.Int64
+	groups atomic.Int64
+	emails atomic.Int64
+	errors atomic.Int64
+	bytes  atomic.Int64
+	// Подробности для отчета report.path
+	report reportLog
+}
 
-	writer := bufio.NewWriter(file)
-	for _, fileEntry := range files {
-		fileRecord := fmt.Sprintf("%s|%s\n", fileEntry.Name, fileEntry.Time.Format("2006-01-02"))
-		_, err := writer.WriteString(fileRecord)
-		if err != nil {
-			log.Printf("Failed to write to sent files log: %v\n", err)
-			return
-		}
+// Сводная строка по завершении проверки; ошибка подключения или
+// подготовки считается одной ошибкой
+func (s *tickStats) log(logger *slog.Logger, err error) {
+	failed := s.errors.Load()
+	if err != nil && failed == 0 {
+		failed = 1
 	}
-	writer.Flush()
+	logger.Info("Check complete", "files", s.files.Load(), "groups", s.groups.Load(), "emails", s.emails.Load(),
+		"errors", failed, "bytes", s.bytes.Load(), "elapsed", time.Since(s.start).Round(time.Millisecond))
 }
 
-// Проверка, был ли файл уже отправлен
-func isFileAlreadySent(file ftp.Entry) bool {
-	fileRecord := fmt.Sprintf("%s|%s", file.Name, file.Time.Format("2006-01-02"))
+// Локальный путь для скачиваемого файла. Относительный путь на сервере
+// сохраняется, чтобы файлы из разных поддиректорий не перезаписывали друг друга.
+func localPath(run *checkRun, name string) string {
+	return filepath.Join(run.tickDir, filepath.FromSlash(path.Clean("/"+name)))
+}
+
+// Скачивание файлов во временную директорию, при ftp.concurrency > 1 - параллельно
+func downloadFiles(ctx context.Context, run *checkRun, src FileSource, files []ftp.Entry) error {
+	return parallelWithSources(ctx, run, src, run.FTP.Concurrency, len(files), func(conn FileSource, i int) error {
+		file := files[i]
+		if err := downloadFileFromFTP(run, conn, file.Name, localPath(run, file.Name)); err != nil {
+			return fmt.Errorf("failed to download file %s: %w", file.Name, err)
+		}
+		return nil
+	})
+}
 
-	fileLog, err := os.Open(sentFilesLog)
+// Скачивание файла через уже открытое соединение
+func downloadFileFromFTP(run *checkRun, src FileSource, remotePath, localPath string) error {
+	if err := os.MkdirAll(filepath.Dir(localPath), 0755); err != nil {
+		return fmt.Errorf("failed to create local directory: %w", err)
+	}
+	file, err := os.Create(localPath)
 	if err != nil {
-		return false
+		return fmt.Errorf("failed to create local file: %w", err)
 	}
-	defer fileLog.Close()
+	defer file.Close()
 
-	scanner := bufio.NewScanner(fileLog)
-	for scanner.Scan() {
-		if scanner.Text() == fileRecord {
-			return true
-		}
+	n, err := retrieveTo(run.Config, src, remotePath, file)
+	run.stats.bytes.Add(n)
+	if err != nil {
+		// Недокачанный файл не должен остаться на диске
+		file.Close()
+		os.Remove(localPath)
+		return err
 	}
-	return false
+
+	return nil
 }
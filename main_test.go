@@ -0,0 +1,152 @@
+package main
+
+import (
+	"errors"
+	"io"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/jlaffaye/ftp"
+)
+
+// Источник, который отдает заданное время изменения или не поддерживает MDTM
+type modTimeSource struct {
+	modTime time.Time
+	err     error
+}
+
+func (s modTimeSource) List(string) ([]*ftp.Entry, error)      { return nil, nil }
+func (s modTimeSource) Retrieve(string) (io.ReadCloser, error) { return nil, errors.ErrUnsupported }
+func (s modTimeSource) Size(string) (int64, error)             { return 0, errors.ErrUnsupported }
+func (s modTimeSource) ModTime(string) (time.Time, error)      { return s.modTime, s.err }
+func (s modTimeSource) Close() error                           { return nil }
+
+// Проверка по текущей config с новым состоянием задания и своей временной директорией
+func testRun(t *testing.T) *checkRun {
+	t.Helper()
+	run := newCheckRun(&config, newJobState())
+	run.tickDir = t.TempDir()
+	return run
+}
+
+// Пустой журнал отметок и проверка со сброшенным кэшем времен изменения
+func setupSentLog(t *testing.T) *checkRun {
+	t.Helper()
+	config = Config{}
+	config.State.SentFilesPath = filepath.Join(t.TempDir(), "sent_files.log")
+
+	s, err := openStore()
+	if err != nil {
+		t.Fatal(err)
+	}
+	store = s
+	t.Cleanup(func() { store.Close() })
+	return testRun(t)
+}
+
+// Отметка файла, увиденного в списке со временем listed
+func checkedRecord(run *checkRun, src FileSource, name string, listed time.Time) sentRecord {
+	file := ftp.Entry{Name: name, Size: 100, Type: ftp.EntryTypeFile, Time: listed}
+	file.Time = preciseModTime(run, src, &file)
+	return newSentRecord(run, file, nil)
+}
+
+// Файл изменен незадолго до полуночи, а следующая проверка идет уже после нее:
+// ключ отметки не должен зависеть ни от текущей даты, ни от формата времени в LIST
+func TestSentRecordMidnightRollover(t *testing.T) {
+	// Сервер в часовом поясе UTC+3: полночь по его времени - предыдущий день в UTC
+	msk := time.FixedZone("MSK", 3*60*60)
+	modified := time.Date(2024, 1, 2, 23, 59, 30, 0, msk)
+
+	tests := []struct {
+		name string
+		// Время изменения при отметке и при следующей проверке
+		markSrc, checkSrc       FileSource
+		markListed, checkListed time.Time
+	}{
+		{
+			name:        "MDTM",
+			markSrc:     modTimeSource{modTime: modified.UTC()},
+			checkSrc:    modTimeSource{modTime: modified.UTC()},
+			markListed:  modified.Truncate(time.Minute),
+			checkListed: modified.Truncate(time.Minute),
+		},
+		{
+			// LIST показывает время до минуты, а для файлов старше полугода - только дату
+			name:        "LIST without MDTM",
+			markSrc:     modTimeSource{err: errors.ErrUnsupported},
+			checkSrc:    modTimeSource{err: errors.ErrUnsupported},
+			markListed:  time.Date(2024, 1, 2, 23, 59, 0, 0, msk),
+			checkListed: time.Date(2024, 1, 2, 0, 0, 0, 0, msk),
+		},
+		{
+			name:        "MDTM fails after mark",
+			markSrc:     modTimeSource{modTime: modified.UTC()},
+			checkSrc:    modTimeSource{err: errors.New("550 not available")},
+			markListed:  time.Date(2024, 1, 2, 23, 59, 0, 0, msk),
+			checkListed: time.Date(2024, 1, 2, 0, 0, 0, 0, msk),
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			run := setupSentLog(t)
+
+			markFilesAsSent([]sentRecord{checkedRecord(run, tt.markSrc, "release.json", tt.markListed)})
+
+			// Следующая проверка после полуночи и перезапуска
+			run.state = newJobState()
+			if !isFileAlreadySent(checkedRecord(run, tt.checkSrc, "release.json", tt.checkListed)) {
+				t.Errorf("file is not recognized as sent after midnight")
+			}
+			// Файл, измененный на следующий день, остается новым
+			nextDay := tt.checkListed.AddDate(0, 0, 1)
+			next := checkedRecord(run, modTimeSource{err: errors.ErrUnsupported}, "release.json", nextDay)
+			if isFileAlreadySent(next) {
+				t.Errorf("file modified on %s is recognized as sent", nextDay.Format("2006-01-02"))
+			}
+		})
+	}
+}
+
+// Сервер не сообщает время: отметка не зависит от времени первого обнаружения
+func TestSentRecordWithoutModTime(t *testing.T) {
+	run := setupSentLog(t)
+	src := modTimeSource{err: errors.ErrUnsupported}
+
+	markFilesAsSent([]sentRecord{checkedRecord(run, src, "release.json", time.Time{})})
+
+	// После перезапуска время первого обнаружения будет другим
+	run.state = newJobState()
+	if !isFileAlreadySent(checkedRecord(run, src, "release.json", time.Time{})) {
+		t.Errorf("file without modification time is not recognized as sent after restart")
+	}
+
+	file := ftp.Entry{Name: "release.json", Size: 200, Type: ftp.EntryTypeFile}
+	file.Time = preciseModTime(run, src, &file)
+	if isFileAlreadySent(newSentRecord(run, file, nil)) {
+		t.Errorf("file with a different size is recognized as sent")
+	}
+}
+
+// Сведения о файлах, пропавших из списка, удаляются, а о файлах в списке -
+// сохраняются вместе с временем первого обнаружения
+func TestPruneModTimes(t *testing.T) {
+	run := setupSentLog(t)
+	src := modTimeSource{err: errors.ErrUnsupported}
+	kept := &ftp.Entry{Name: "kept.json", Size: 100, Type: ftp.EntryTypeFile}
+	removed := &ftp.Entry{Name: "removed.json", Size: 100, Type: ftp.EntryTypeFile}
+	firstSeen := preciseModTime(run, src, kept)
+	preciseModTime(run, src, removed)
+
+	run.state.pruneModTimes([]*ftp.Entry{{Name: "kept.json", Size: 100, Type: ftp.EntryTypeFile}})
+	if len(run.state.modTimes) != 1 || len(run.state.precision) != 1 {
+		t.Fatalf("caches hold %d times and %d precisions, want 1 each", len(run.state.modTimes), len(run.state.precision))
+	}
+	if _, ok := run.state.precision["removed.json"]; ok {
+		t.Errorf("removed file is still cached")
+	}
+	if got := preciseModTime(run, src, &ftp.Entry{Name: "kept.json", Size: 100, Type: ftp.EntryTypeFile}); !got.Equal(firstSeen) {
+		t.Errorf("first seen time changed from %s to %s", firstSeen, got)
+	}
+}
@@ -0,0 +1,74 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// Счетчики работы уведомителя, отдаваемые в формате Prometheus
+type metrics struct {
+	filesFound     atomic.Int64
+	emailsSent     atomic.Int64
+	emailsFailed   atomic.Int64
+	ftpErrors      atomic.Int64
+	lastSuccessful atomic.Int64 // unix-время последней успешной проверки любого задания
+
+	// Результаты последних проверок по имени задания (для готовности)
+	checksMu sync.Mutex
+	checks   map[string]checkState
+}
+
+// Результат последней проверки задания
+type checkState struct {
+	lastSuccessful time.Time
+	failed         bool
+}
+
+var appMetrics metrics
+
+// Отметка об успешно завершенной проверке задания job
+func (m *metrics) tickSucceeded(job string) {
+	now := time.Now()
+	m.lastSuccessful.Store(now.Unix())
+	m.setCheck(job, checkState{lastSuccessful: now})
+}
+
+// Отметка о проверке задания job, завершившейся ошибкой
+func (m *metrics) tickFailed(job string) {
+	state := m.lastCheck(job)
+	state.failed = true
+	m.setCheck(job, state)
+}
+
+// Результат последней проверки задания; нулевой, если проверок еще не было
+func (m *metrics) lastCheck(job string) checkState {
+	m.checksMu.Lock()
+	defer m.checksMu.Unlock()
+	return m.checks[job]
+}
+
+func (m *metrics) setCheck(job string, state checkState) {
+	m.checksMu.Lock()
+	defer m.checksMu.Unlock()
+	if m.checks == nil {
+		m.checks = make(map[string]checkState)
+	}
+	m.checks[job] = state
+}
+
+// Вывод метрик в текстовом формате Prometheus
+func (m *metrics) serveHTTP(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+	writeMetric(w, "ftpnotifier_files_found_total", "counter", "New files found on the server.", m.filesFound.Load())
+	writeMetric(w, "ftpnotifier_emails_sent_total", "counter", "Emails sent successfully.", m.emailsSent.Load())
+	writeMetric(w, "ftpnotifier_emails_failed_total", "counter", "Emails that failed to send.", m.emailsFailed.Load())
+	writeMetric(w, "ftpnotifier_ftp_errors_total", "counter", "Errors connecting to or reading from the file server.", m.ftpErrors.Load())
+	writeMetric(w, "ftpnotifier_last_success_timestamp_seconds", "gauge", "Unix time of the last successful check.", m.lastSuccessful.Load())
+}
+
+func writeMetric(w http.ResponseWriter, name, kind, help string, value int64) {
+	fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s %s\n%s %d\n", name, help, name, kind, name, value)
+}
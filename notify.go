@@ -0,0 +1,100 @@
+package main
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"sync"
+)
+
+// Способ уведомления о релизах по группам файлов
+type Notifier interface {
+	// Имя для учета доставленных уведомлений
+	Name() string
+	Notify(ctx context.Context, run *checkRun, src FileSource, groups []releaseGroup) error
+}
+
+// Уведомления по настройкам: письмо (кроме webhook.only) и веб-хук, если задан
+func notifiers(cfg *Config) []Notifier {
+	var list []Notifier
+	if !cfg.Webhook.Only {
+		list = append(list, emailNotifier{})
+	}
+	if cfg.Webhook.URL != "" {
+		list = append(list, webhookNotifier{url: cfg.Webhook.URL})
+	}
+	return list
+}
+
+// Уведомления, уже доставленные по группам, отправка которых не удалась
+// другим способом. Группа повторяется на следующей проверке, и доставленные
+// уведомления при этом не отправляются снова.
+var delivered = struct {
+	sync.Mutex
+	m map[string]bool
+}{m: make(map[string]bool)}
+
+// Отправка уведомлений всеми способами; ошибка, если не удался хотя бы один.
+// Способы, которые уже доставили эти группы, пропускаются.
+func notify(ctx context.Context, run *checkRun, src FileSource, groups []releaseGroup) error {
+	key := recordName(run.Name, deliveryKey(groups))
+	var errs []error
+	for _, n := range notifiers(run.Config) {
+		done := n.Name() + "/" + key
+		delivered.Lock()
+		skip := delivered.m[done]
+		delivered.Unlock()
+		if skip {
+			continue
+		}
+		if err := n.Notify(ctx, run, src, groups); err != nil {
+			errs = append(errs, err)
+			continue
+		}
+		if !dryRun {
+			delivered.Lock()
+			delivered.m[done] = true
+			delivered.Unlock()
+		}
+	}
+	if len(errs) > 0 {
+		return errors.Join(errs...)
+	}
+
+	// Группы доставлены всеми способами, учет больше не нужен
+	delivered.Lock()
+	for _, n := range notifiers(run.Config) {
+		delete(delivered.m, n.Name()+"/"+key)
+	}
+	delivered.Unlock()
+	return nil
+}
+
+// Ключ групп для учета доставки: даты и записи манифестов; в notify к нему
+// добавляется имя задания, как в отметках (recordName). Локальные пути
+// исходных JSON-файлов меняются от проверки к проверке и в ключ не входят.
+func deliveryKey(groups []releaseGroup) string {
+	h := sha256.New()
+	for _, group := range groups {
+		json.NewEncoder(h).Encode(struct {
+			Date string
+			Data []ReleaseData
+		}{group.Date, group.Data})
+	}
+	return hex.EncodeToString(h.Sum(nil))
+}
+
+// Уведомление письмом
+type emailNotifier struct{}
+
+func (emailNotifier) Name() string { return "email" }
+
+func (emailNotifier) Notify(ctx context.Context, run *checkRun, src FileSource, groups []releaseGroup) error {
+	if err := sendReleaseEmail(ctx, run, src, groups); err != nil {
+		return fmt.Errorf("email: %w", err)
+	}
+	return nil
+}
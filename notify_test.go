@@ -0,0 +1,71 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+)
+
+// Письма, переданные на отправку
+type countingMailer struct {
+	sent *int
+}
+
+func (m countingMailer) Send(ctx context.Context, msg emailMessage) error {
+	*m.sent++
+	return nil
+}
+
+// Сбой веб-хука после доставленного письма: группа повторяется, но письмо
+// второй раз не отправляется
+func TestNotifySkipsDeliveredNotifiers(t *testing.T) {
+	var failing atomic.Bool
+	failing.Store(true)
+	var posts atomic.Int32
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		posts.Add(1)
+		if failing.Load() {
+			w.WriteHeader(http.StatusInternalServerError)
+		}
+	}))
+	defer server.Close()
+
+	config = Config{}
+	config.SMTP.Subject = "Релиз"
+	config.SMTP.To = []string{"team@example.com"}
+	config.Webhook.URL = server.URL
+	run := testRun(t)
+	sent := 0
+	mailer := newMailer
+	newMailer = func(*checkRun) Mailer { return countingMailer{sent: &sent} }
+	t.Cleanup(func() { newMailer = mailer })
+
+	groups := []releaseGroup{{Date: "2024-01-02", Data: []ReleaseData{{ZipFileName: "app.zip", TeamcityBuildCounter: 7}}}}
+	if err := notify(context.Background(), run, modTimeSource{}, groups); err == nil {
+		t.Fatal("webhook failure is not reported")
+	}
+	if sent != 1 {
+		t.Fatalf("emails sent = %d, want 1", sent)
+	}
+
+	failing.Store(false)
+	if err := notify(context.Background(), run, modTimeSource{}, groups); err != nil {
+		t.Fatal(err)
+	}
+	if sent != 1 {
+		t.Errorf("email is sent again on retry: %d emails", sent)
+	}
+	if posts.Load() != 2 {
+		t.Errorf("webhook posts = %d, want 2", posts.Load())
+	}
+
+	// После доставки всеми способами учет сбрасывается
+	if err := notify(context.Background(), run, modTimeSource{}, groups); err != nil {
+		t.Fatal(err)
+	}
+	if sent != 2 {
+		t.Errorf("emails sent = %d after full delivery, want 2", sent)
+	}
+}
@@ -0,0 +1,54 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"os"
+	"strings"
+
+	"github.com/ProtonMail/go-crypto/openpgp"
+)
+
+// Имя вложения с отделенной подписью текста письма
+const signatureAttachment = "signature.asc"
+
+// Ключ подписи писем из smtp.pgp_key_file (закрытый ключ в ASCII armor);
+// nil, если подпись не настроена. Зашифрованный ключ расшифровывается
+// паролем smtp.pgp_passphrase.
+func loadSigningKey(cfg *Config) (*openpgp.Entity, error) {
+	if cfg.SMTP.PGPKeyFile == "" {
+		return nil, nil
+	}
+	file, err := os.Open(cfg.SMTP.PGPKeyFile)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open PGP key: %w", err)
+	}
+	defer file.Close()
+
+	keys, err := openpgp.ReadArmoredKeyRing(file)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read PGP key %s: %w", cfg.SMTP.PGPKeyFile, err)
+	}
+	key := keys[0]
+	if key.PrivateKey == nil {
+		return nil, fmt.Errorf("PGP key %s has no private key", cfg.SMTP.PGPKeyFile)
+	}
+	if key.PrivateKey.Encrypted {
+		if err := key.DecryptPrivateKeys([]byte(cfg.SMTP.PGPPassphrase)); err != nil {
+			return nil, fmt.Errorf("failed to decrypt PGP key %s: %w", cfg.SMTP.PGPKeyFile, err)
+		}
+	}
+	return key, nil
+}
+
+// Отделенная подпись текста письма в ASCII armor. Текст подписывается
+// в каноническом виде, поэтому замена переводов строк при доставке
+// не нарушает подпись.
+func signBody(key *openpgp.Entity, body string) ([]byte, error) {
+	var buf bytes.Buffer
+	if err := openpgp.ArmoredDetachSignText(&buf, key, strings.NewReader(body), nil); err != nil {
+		return nil, fmt.Errorf("failed to sign email: %w", err)
+	}
+	buf.WriteByte('\n')
+	return buf.Bytes(), nil
+}
@@ -0,0 +1,91 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"net/url"
+	"strconv"
+	"time"
+
+	"golang.org/x/net/proxy"
+)
+
+// SOCKS5-прокси из ftp.proxy: socks5://[user:pass@]host:port (socks5h - то же)
+// или unix:///path/to/socket для прокси на Unix-сокете
+func newProxyDialer(rawURL string) (proxy.ContextDialer, error) {
+	u, err := url.Parse(rawURL)
+	if err != nil {
+		return nil, fmt.Errorf("invalid proxy URL: %w", err)
+	}
+
+	var dialer proxy.Dialer
+	switch u.Scheme {
+	case "socks5", "socks5h":
+		if u.Host == "" {
+			return nil, fmt.Errorf("proxy URL must include host:port")
+		}
+		dialer, err = proxy.FromURL(u, proxy.Direct)
+	case "unix":
+		if u.Path == "" {
+			return nil, fmt.Errorf("proxy URL must include socket path")
+		}
+		var auth *proxy.Auth
+		if u.User != nil {
+			password, _ := u.User.Password()
+			auth = &proxy.Auth{User: u.User.Username(), Password: password}
+		}
+		dialer, err = proxy.SOCKS5("unix", u.Path, auth, proxy.Direct)
+	default:
+		return nil, fmt.Errorf("unsupported proxy scheme %q (expected socks5, socks5h or unix)", u.Scheme)
+	}
+	if err != nil {
+		return nil, err
+	}
+	contextDialer, ok := dialer.(proxy.ContextDialer)
+	if !ok {
+		return nil, fmt.Errorf("proxy dialer does not support timeouts")
+	}
+	return contextDialer, nil
+}
+
+// Соединение с сервером: через ftp.proxy, если он задан, иначе напрямую.
+// Таймаут подключения распространяется и на рукопожатие SOCKS5
+func dialServer(cfg *Config, network, addr string, timeout time.Duration) (net.Conn, error) {
+	if cfg.FTP.Proxy == "" {
+		return net.DialTimeout(network, addr, timeout)
+	}
+
+	dialer, err := newProxyDialer(cfg.FTP.Proxy)
+	if err != nil {
+		return nil, fmt.Errorf("ftp.proxy: %w", err)
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+	conn, err := dialer.DialContext(ctx, network, addr)
+	if err != nil {
+		return nil, fmt.Errorf("failed to connect via proxy: %w", err)
+	}
+	return &proxyConn{Conn: conn, remote: proxyTarget(addr)}, nil
+}
+
+// Соединение через прокси сообщает адрес сервера, а не прокси: jlaffaye/ftp
+// берет из RemoteAddr хост для соединений данных после EPSV
+type proxyConn struct {
+	net.Conn
+	remote *net.TCPAddr
+}
+
+func (c *proxyConn) RemoteAddr() net.Addr {
+	return c.remote
+}
+
+// Адрес назначения; для имени хоста IP остается пустым - имя разрешает прокси
+func proxyTarget(addr string) *net.TCPAddr {
+	host, port, err := net.SplitHostPort(addr)
+	if err != nil {
+		return &net.TCPAddr{}
+	}
+	p, _ := strconv.Atoi(port)
+	return &net.TCPAddr{IP: net.ParseIP(host), Port: p}
+}
@@ -0,0 +1,53 @@
+package main
+
+import (
+	"math"
+	"sync"
+	"time"
+
+	"golang.org/x/time/rate"
+)
+
+// Ограничители частоты команд по адресу сервера: соединения всех заданий
+// и параллельных загрузок к одному серверу расходуют общий запас
+var (
+	ftpLimitersMu sync.Mutex
+	ftpLimiters   = make(map[string]*rate.Limiter)
+)
+
+// Ожидание разрешения на команду op по ftp.max_ops_per_sec (0 - без ограничения)
+func waitFTPRate(run *checkRun, op string) {
+	limiter := ftpLimiter(run.Config)
+	if limiter == nil {
+		return
+	}
+	delay := limiter.Reserve().Delay()
+	if delay > 0 {
+		run.log.Debug("Waiting for FTP rate limit", "op", op, "wait", delay)
+		time.Sleep(delay)
+	}
+}
+
+// Ограничитель для текущего сервера; при изменении ftp.max_ops_per_sec
+// после перезагрузки конфигурации лимит обновляется
+func ftpLimiter(cfg *Config) *rate.Limiter {
+	opsPerSec := cfg.FTP.MaxOpsPerSec
+	if opsPerSec <= 0 {
+		return nil
+	}
+	limit := rate.Limit(opsPerSec)
+	burst := int(math.Max(1, math.Ceil(opsPerSec)))
+
+	ftpLimitersMu.Lock()
+	defer ftpLimitersMu.Unlock()
+	addr := ftpAddress(cfg)
+	limiter, ok := ftpLimiters[addr]
+	if !ok {
+		limiter = rate.NewLimiter(limit, burst)
+		ftpLimiters[addr] = limiter
+	} else if limiter.Limit() != limit {
+		limiter.SetLimit(limit)
+		limiter.SetBurst(burst)
+	}
+	return limiter
+}
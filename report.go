@@ -0,0 +1,128 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+)
+
+// Отчет о проверке для внешних систем (report.path): найденные файлы,
+// группы, отправленные письма и ошибки
+type runReport struct {
+	Job      string        `json:"job,omitempty"`
+	Started  time.Time     `json:"started"`
+	Finished time.Time     `json:"finished"`
+	DryRun   bool          `json:"dry_run,omitempty"`
+	Files    []string      `json:"files"`
+	Groups   []string      `json:"groups"`
+	Emails   []reportEmail `json:"emails"`
+	Errors   []reportError `json:"errors"`
+}
+
+type reportEmail struct {
+	Time    time.Time `json:"time"`
+	To      []string  `json:"to"`
+	Subject string    `json:"subject"`
+}
+
+type reportError struct {
+	Time    time.Time `json:"time"`
+	Message string    `json:"message"`
+}
+
+// Данные отчета, собираемые во время проверки; группы обрабатываются
+// параллельно, поэтому доступ через мьютекс
+type reportLog struct {
+	mu     sync.Mutex
+	files  []string
+	groups []string
+	emails []reportEmail
+	errors []reportError
+}
+
+func (r *reportLog) addEmail(to []string, subject string) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.emails = append(r.emails, reportEmail{Time: time.Now(), To: to, Subject: subject})
+}
+
+func (r *reportLog) addError(err error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.errors = append(r.errors, reportError{Time: time.Now(), Message: err.Error()})
+}
+
+// Запись отчета о завершенной проверке. Ошибка err, прервавшая проверку,
+// добавляется к ошибкам групп. Сбой записи отчета на проверку не влияет.
+func writeReport(run *checkRun, err error) {
+	if run.Report.Path == "" {
+		return
+	}
+	r := &run.stats.report
+	if err != nil {
+		r.addError(err)
+	}
+
+	// Пустые списки записываются как [], а не null
+	r.mu.Lock()
+	report := runReport{
+		Job:      run.Name,
+		Started:  run.stats.start,
+		Finished: time.Now(),
+		DryRun:   dryRun,
+		Files:    append([]string{}, r.files...),
+		Groups:   append([]string{}, r.groups...),
+		Emails:   append([]reportEmail{}, r.emails...),
+		Errors:   append([]reportError{}, r.errors...),
+	}
+	r.mu.Unlock()
+
+	// Задания с общим report.path пишут отчеты по очереди
+	reportMu.Lock()
+	defer reportMu.Unlock()
+	if err := saveReport(run.Report.Path, run.Report.Mode, report); err != nil {
+		run.log.Warn("Failed to write run report", "path", run.Report.Path, "error", err)
+	}
+}
+
+var reportMu sync.Mutex
+
+// Сохранение отчета: при report.mode: append - строкой JSON в конец файла,
+// иначе файл заменяется целиком через временный файл
+func saveReport(path, mode string, report runReport) error {
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		return err
+	}
+
+	if mode == "append" {
+		line, err := json.Marshal(report)
+		if err != nil {
+			return err
+		}
+		file, err := os.OpenFile(path, os.O_CREATE|os.O_APPEND|os.O_WRONLY, 0644)
+		if err != nil {
+			return err
+		}
+		if _, err := file.Write(append(line, '\n')); err != nil {
+			file.Close()
+			return err
+		}
+		return file.Close()
+	}
+
+	content, err := json.MarshalIndent(report, "", "  ")
+	if err != nil {
+		return err
+	}
+	tmpPath := path + ".tmp"
+	if err := os.WriteFile(tmpPath, append(content, '\n'), 0644); err != nil {
+		return err
+	}
+	if err := os.Rename(tmpPath, path); err != nil {
+		return fmt.Errorf("failed to replace report: %w", err)
+	}
+	return nil
+}
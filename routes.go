@@ -0,0 +1,158 @@
+package main
+
+import (
+	"maps"
+	"reflect"
+	"regexp"
+	"slices"
+	"strings"
+)
+
+// Маршрут рассылки: получатели to получают только записи с подходящей
+// платформой и именем архива. Пустой список условий не ограничивает выборку.
+type Route struct {
+	To        []string `yaml:"to"`
+	Platforms []string `yaml:"platforms"`
+	// Маски glob для имени архива (ZipFileName)
+	Patterns []string `yaml:"patterns"`
+}
+
+// Письмо для группы получателей с отобранными для них записями
+type delivery struct {
+	To     []string
+	Groups []releaseGroup
+}
+
+// Распределение релизов по получателям. Получатели из smtp.to без маршрута
+// получают все записи; получатели маршрута и найденные по полям манифеста -
+// только подходящие им.
+// Маршруты, для которых не нашлось ни одной записи, пропускаются.
+func routeDeliveries(cfg *Config, groups []releaseGroup) []delivery {
+	var deliveries []delivery
+	routed := make(map[string]bool)
+	for _, route := range cfg.SMTP.Routes {
+		for _, to := range route.To {
+			routed[to] = true
+		}
+		filtered := route.filter(groups)
+		if len(filtered) > 0 {
+			deliveries = append(deliveries, delivery{To: route.To, Groups: filtered})
+		}
+	}
+
+	var unrouted, fields []string
+	for _, to := range cfg.SMTP.To {
+		if field, ok := recipientField(to); ok {
+			fields = append(fields, field)
+		} else if !routed[to] {
+			unrouted = append(unrouted, to)
+		}
+	}
+	if len(unrouted) > 0 {
+		deliveries = append([]delivery{{To: unrouted, Groups: groups}}, deliveries...)
+	}
+	if len(fields) > 0 {
+		deliveries = append(deliveries, fieldDeliveries(cfg, groups, fields, unrouted)...)
+	}
+	return deliveries
+}
+
+// Ссылка на поле манифеста в smtp.to: "{BranchName}"
+func recipientField(to string) (string, bool) {
+	to = strings.TrimSpace(to)
+	if len(to) > 2 && strings.HasPrefix(to, "{") && strings.HasSuffix(to, "}") {
+		return to[1 : len(to)-1], true
+	}
+	return "", false
+}
+
+// Текстовое поле записи манифеста по имени
+func manifestField(entry ReleaseData, name string) (string, bool) {
+	field := reflect.ValueOf(entry).FieldByName(name)
+	if !field.IsValid() || field.Kind() != reflect.String {
+		return "", false
+	}
+	return field.String(), true
+}
+
+// Получатели записи по таблицам smtp.recipients для полей fields
+func entryRecipients(cfg *Config, entry ReleaseData, fields []string) []string {
+	var recipients []string
+	for _, field := range fields {
+		value, _ := manifestField(entry, field)
+		if value == "" {
+			continue
+		}
+		for pattern, addresses := range cfg.SMTP.Recipients[field] {
+			// Маски проверены при загрузке конфигурации
+			patterns, _ := compilePatterns([]string{pattern}, "glob", false)
+			if len(patterns) > 0 && patterns[0].MatchString(value) {
+				recipients = append(recipients, addresses...)
+			}
+		}
+	}
+	slices.Sort(recipients)
+	return slices.Compact(recipients)
+}
+
+// Письма получателям, найденным по полям манифеста: каждому - отдельное письмо
+// с записями, которые к нему привели. Получатели из skip уже получают все записи.
+func fieldDeliveries(cfg *Config, groups []releaseGroup, fields []string, skip []string) []delivery {
+	byRecipient := make(map[string][]releaseGroup)
+	for _, group := range groups {
+		matched := make(map[string][]ReleaseData)
+		for _, entry := range group.Data {
+			for _, to := range entryRecipients(cfg, entry, fields) {
+				if !slices.Contains(skip, to) {
+					matched[to] = append(matched[to], entry)
+				}
+			}
+		}
+		for to, data := range matched {
+			filtered := group
+			filtered.Data = data
+			byRecipient[to] = append(byRecipient[to], filtered)
+		}
+	}
+
+	var deliveries []delivery
+	for _, to := range slices.Sorted(maps.Keys(byRecipient)) {
+		deliveries = append(deliveries, delivery{To: []string{to}, Groups: byRecipient[to]})
+	}
+	return deliveries
+}
+
+// Группы только с подходящими маршруту записями; пустые группы отбрасываются
+func (r Route) filter(groups []releaseGroup) []releaseGroup {
+	patterns, _ := compilePatterns(r.Patterns, "glob", false)
+
+	var filtered []releaseGroup
+	for _, group := range groups {
+		var data []ReleaseData
+		for _, entry := range group.Data {
+			if r.matches(entry, patterns) {
+				data = append(data, entry)
+			}
+		}
+		if len(data) > 0 {
+			group.Data = data
+			filtered = append(filtered, group)
+		}
+	}
+	return filtered
+}
+
+func (r Route) matches(entry ReleaseData, patterns []*regexp.Regexp) bool {
+	if len(r.Platforms) > 0 && !slices.Contains(r.Platforms, entry.Platform) {
+		return false
+	}
+	if len(patterns) == 0 {
+		return true
+	}
+	for _, re := range patterns {
+		if re.MatchString(entry.ZipFileName) {
+			return true
+		}
+	}
+	return false
+}
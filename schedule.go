@@ -0,0 +1,119 @@
+package main
+
+import (
+	"log/slog"
+	"math/rand/v2"
+	"time"
+
+	"github.com/robfig/cron/v3"
+)
+
+// Запуск проверок каждого задания по его ftp.schedule или с интервалом ftp.period.
+// Возвращает функцию остановки, которая дожидается текущих проверок.
+func startChecks(immediate bool) (stop func()) {
+	var stops []func()
+	for i, job := range jobs {
+		check := func() {
+			if err := runJob(i); err != nil {
+				slog.Error("Check failed", "job", job.Name, "error", err)
+			}
+		}
+		if job.FTP.Schedule != "" {
+			stops = append(stops, startScheduled(job.FTP.Schedule, check))
+		} else {
+			period := time.Duration(job.FTP.Period)
+			stops = append(stops, startTicker(period, job.FTP.Jitter.of(period), immediate, check))
+		}
+	}
+	return func() {
+		for _, stop := range stops {
+			stop()
+		}
+	}
+}
+
+// Проверки с фиксированным интервалом; при immediate первая проверка
+// выполняется сразу, не дожидаясь первого срабатывания таймера. При jitter
+// каждый интервал и первая проверка откладываются на случайную величину до
+// jitter, чтобы экземпляры, запущенные одновременно, не обращались к серверу разом.
+func startTicker(period, jitter time.Duration, immediate bool, check func()) (stop func()) {
+	next := func() time.Duration {
+		if jitter <= 0 {
+			return period
+		}
+		return period + rand.N(jitter)
+	}
+	ticker := time.NewTicker(next())
+	done := make(chan struct{})
+	finished := make(chan struct{})
+
+	go func() {
+		defer close(finished)
+		if immediate {
+			// Первая проверка тоже откладывается на случайную величину до jitter,
+			// иначе одновременно запущенные экземпляры обратятся к серверу разом
+			if jitter > 0 {
+				delay := time.NewTimer(rand.N(jitter))
+				select {
+				case <-done:
+					delay.Stop()
+					return
+				case <-delay.C:
+				}
+			}
+			check()
+			if jitter > 0 {
+				ticker.Reset(next())
+			}
+		}
+		for {
+			select {
+			case <-done:
+				return
+			case <-ticker.C:
+				if jitter > 0 {
+					ticker.Reset(next())
+				}
+				check()
+			}
+		}
+	}()
+
+	slog.Info("Running periodically", "period", period, "jitter", jitter)
+	return func() {
+		ticker.Stop()
+		close(done)
+		<-finished
+	}
+}
+
+// Запуск проверок по расписанию ftp.schedule в стандартном формате cron
+// из пяти полей ("0 8 * * 1-5" - по будням в 08:00). Время считается в
+// локальном часовом поясе процесса; другой пояс задается префиксом
+// CRON_TZ, например "CRON_TZ=Europe/Moscow 0 8 * * 1-5". Если предыдущая
+// проверка еще выполняется, очередной запуск пропускается.
+func startScheduled(schedule string, check func()) (stop func()) {
+	logger := cronLogger{}
+	c := cron.New(cron.WithLogger(logger), cron.WithChain(cron.SkipIfStillRunning(logger)))
+	_, err := c.AddFunc(schedule, check)
+	if err != nil {
+		fatal("Invalid ftp.schedule", "schedule", schedule, "error", err)
+	}
+
+	slog.Info("Running on schedule", "schedule", schedule)
+	c.Start()
+	return func() {
+		<-c.Stop().Done()
+	}
+}
+
+// Вывод сообщений планировщика в общий лог
+type cronLogger struct{}
+
+func (cronLogger) Info(msg string, keysAndValues ...interface{}) {
+	slog.Debug(msg, keysAndValues...)
+}
+
+func (cronLogger) Error(err error, msg string, keysAndValues ...interface{}) {
+	slog.Error(msg, append(keysAndValues, "error", err)...)
+}
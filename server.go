@@ -0,0 +1,36 @@
+package main
+
+import (
+	"log/slog"
+	"net/http"
+)
+
+// Запуск служебных HTTP-серверов: метрики (metrics.addr) и проверки
+// состояния (health.addr). Если адреса совпадают, обработчики
+// обслуживаются одним сервером.
+func startHTTPServers() {
+	muxes := make(map[string]*http.ServeMux)
+	mux := func(addr string) *http.ServeMux {
+		if muxes[addr] == nil {
+			muxes[addr] = http.NewServeMux()
+		}
+		return muxes[addr]
+	}
+
+	if config.Metrics.Addr != "" {
+		mux(config.Metrics.Addr).HandleFunc("/metrics", appMetrics.serveHTTP)
+	}
+	if config.Health.Addr != "" {
+		mux(config.Health.Addr).HandleFunc("/healthz", serveHealthz)
+		mux(config.Health.Addr).HandleFunc("/readyz", serveReadyz)
+	}
+
+	for addr, handler := range muxes {
+		go func() {
+			slog.Info("Starting HTTP server", "addr", addr)
+			if err := http.ListenAndServe(addr, handler); err != nil {
+				slog.Error("HTTP server stopped", "addr", addr, "error", err)
+			}
+		}()
+	}
+}
@@ -0,0 +1,203 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"os"
+	"path"
+	"path/filepath"
+	"time"
+
+	"github.com/jlaffaye/ftp"
+	"github.com/pkg/sftp"
+	"golang.org/x/crypto/ssh"
+	"golang.org/x/crypto/ssh/knownhosts"
+)
+
+// Источник файлов на SFTP-сервере (клиент github.com/pkg/sftp поверх SSH)
+type sftpSource struct {
+	client *ssh.Client
+	sftp   *sftp.Client
+	dir    string
+	// Отмена прерывания соединения по контексту проверки
+	stop func() bool
+}
+
+// Подключение к SFTP-серверу и определение рабочей директории.
+// При отмене ctx у соединения истекает таймаут (connGroup).
+func connectSFTP(ctx context.Context, run *checkRun) (_ *sftpSource, err error) {
+	clientConfig, err := sshClientConfig(run)
+	if err != nil {
+		return nil, err
+	}
+
+	conns := &connGroup{}
+	stop := context.AfterFunc(ctx, conns.interrupt)
+	defer func() {
+		if err != nil {
+			stop()
+		}
+	}()
+
+	conn, err := dialServer(run.Config, "tcp", ftpAddress(run.Config), dialTimeout(run.Config))
+	if err != nil {
+		return nil, fmt.Errorf("failed to connect to SFTP server: %w", err)
+	}
+	conn = conns.add(conn)
+	// Таймаут подключения распространяется и на рукопожатие SSH
+	conn.SetDeadline(time.Now().Add(dialTimeout(run.Config)))
+	c, chans, reqs, err := ssh.NewClientConn(conn, ftpAddress(run.Config), clientConfig)
+	if err != nil {
+		conn.Close()
+		return nil, fmt.Errorf("failed to connect to SFTP server: %w", err)
+	}
+	client := ssh.NewClient(c, chans, reqs)
+
+	sc, err := sftp.NewClient(client)
+	if err != nil {
+		client.Close()
+		return nil, fmt.Errorf("failed to start SFTP session: %w", err)
+	}
+
+	// Проверяем, что директория существует, и приводим путь к абсолютному
+	dir := run.FTP.Dir
+	if dir == "" {
+		dir = "."
+	}
+	dir, err = sc.RealPath(dir)
+	if err == nil {
+		_, err = sc.Stat(dir)
+	}
+	if err != nil {
+		client.Close()
+		sc.Close()
+		return nil, fmt.Errorf("failed to change directory: %w", err)
+	}
+	conn.SetDeadline(time.Time{})
+
+	return &sftpSource{client: client, sftp: sc, dir: dir, stop: stop}, nil
+}
+
+// Настройки SSH: авторизация по паролю и/или ключу, проверка ключа сервера
+// по known_hosts
+func sshClientConfig(run *checkRun) (*ssh.ClientConfig, error) {
+	var auth []ssh.AuthMethod
+	if run.FTP.KeyFile != "" {
+		key, err := os.ReadFile(run.FTP.KeyFile)
+		if err != nil {
+			return nil, fmt.Errorf("failed to read SSH key: %w", err)
+		}
+		signer, err := ssh.ParsePrivateKey(key)
+		if err != nil {
+			return nil, fmt.Errorf("failed to parse SSH key: %w", err)
+		}
+		auth = append(auth, ssh.PublicKeys(signer))
+	}
+	if run.FTP.Password != "" {
+		auth = append(auth, ssh.Password(run.FTP.Password))
+	}
+
+	hostKeyCallback, err := sshHostKeyCallback(run)
+	if err != nil {
+		return nil, err
+	}
+
+	return &ssh.ClientConfig{
+		User:            run.FTP.User,
+		Auth:            auth,
+		HostKeyCallback: hostKeyCallback,
+		Timeout:         dialTimeout(run.Config),
+	}, nil
+}
+
+// Проверка ключа сервера по ftp.known_hosts, по умолчанию ~/.ssh/known_hosts.
+// Без проверки подключение возможно только при ftp.insecure_ignore_host_key.
+func sshHostKeyCallback(run *checkRun) (ssh.HostKeyCallback, error) {
+	if run.FTP.InsecureIgnoreHostKey {
+		run.log.Warn("ftp.insecure_ignore_host_key is set, SFTP server key is not verified")
+		return ssh.InsecureIgnoreHostKey(), nil
+	}
+
+	knownHosts := run.FTP.KnownHosts
+	if knownHosts == "" {
+		home, err := os.UserHomeDir()
+		if err != nil {
+			return nil, fmt.Errorf("failed to locate known_hosts, set ftp.known_hosts: %w", err)
+		}
+		knownHosts = filepath.Join(home, ".ssh", "known_hosts")
+	}
+	callback, err := knownhosts.New(knownHosts)
+	if err != nil {
+		return nil, fmt.Errorf("failed to load known_hosts (set ftp.known_hosts or ftp.insecure_ignore_host_key): %w", err)
+	}
+	return callback, nil
+}
+
+func (s *sftpSource) List(dir string) ([]*ftp.Entry, error) {
+	infos, err := s.sftp.ReadDir(s.resolve(dir))
+	if err != nil {
+		return nil, err
+	}
+	entries := make([]*ftp.Entry, 0, len(infos))
+	for _, info := range infos {
+		entries = append(entries, sftpEntry(info))
+	}
+	return entries, nil
+}
+
+// Файл передается через уже открытое соединение, поэтому ftp.download_timeout
+// для SFTP не применяется; зависшая загрузка прерывается отменой контекста проверки
+func (s *sftpSource) Retrieve(name string) (io.ReadCloser, error) {
+	return s.sftp.Open(s.resolve(name))
+}
+
+func (s *sftpSource) Size(name string) (int64, error) {
+	info, err := s.sftp.Stat(s.resolve(name))
+	if err != nil {
+		return 0, err
+	}
+	return info.Size(), nil
+}
+
+func (s *sftpSource) ModTime(name string) (time.Time, error) {
+	info, err := s.sftp.Stat(s.resolve(name))
+	if err != nil {
+		return time.Time{}, err
+	}
+	return info.ModTime(), nil
+}
+
+// Сначала закрывается соединение SSH: клиент SFTP при закрытии ждет,
+// пока сервер закроет канал, и мог бы зависнуть
+func (s *sftpSource) Close() error {
+	s.stop()
+	err := s.client.Close()
+	s.sftp.Close()
+	return err
+}
+
+// Путь относительно рабочей директории, как у FTP после ChangeDir
+func (s *sftpSource) resolve(name string) string {
+	if path.IsAbs(name) {
+		return name
+	}
+	return path.Join(s.dir, name)
+}
+
+// Запись директории SFTP в виде ftp.Entry; ссылки не разыменовываются
+func sftpEntry(info os.FileInfo) *ftp.Entry {
+	entry := &ftp.Entry{
+		Name: info.Name(),
+		Type: ftp.EntryTypeFile,
+		Size: uint64(info.Size()),
+		Time: info.ModTime(),
+	}
+	switch {
+	case info.IsDir():
+		entry.Type = ftp.EntryTypeFolder
+	case info.Mode()&os.ModeSymlink != 0:
+		entry.Type = ftp.EntryTypeLink
+	}
+	return entry
+}
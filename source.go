@@ -0,0 +1,672 @@
+package main
+
+import (
+	"context"
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"path"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/jlaffaye/ftp"
+	"golang.org/x/sync/errgroup"
+)
+
+// Источник файлов релизов. Остальной код работает только через этот интерфейс
+// и не зависит от протокола (FTP или SFTP).
+type FileSource interface {
+	// Список файлов в директории; пустая строка означает рабочую директорию
+	List(dir string) ([]*ftp.Entry, error)
+	// Чтение файла по пути относительно рабочей директории
+	Retrieve(name string) (io.ReadCloser, error)
+	// Размер файла в байтах
+	Size(name string) (int64, error)
+	// Точное время изменения файла
+	ModTime(name string) (time.Time, error)
+	// Закрытие соединения
+	Close() error
+}
+
+// Открытие источника файлов с повторными попытками и экспоненциальной задержкой.
+// Операции источника прерываются при отмене ctx.
+func openSource(ctx context.Context, run *checkRun) (FileSource, error) {
+	delay := time.Second
+	for attempt := 0; ; attempt++ {
+		src, err := withCancel(ctx, "connect", func() (FileSource, error) {
+			return dialSource(ctx, run)
+		})
+		if err == nil {
+			return withContext(ctx, src), nil
+		}
+		if attempt >= run.FTP.Retries || ctx.Err() != nil {
+			return nil, err
+		}
+		run.log.Warn("Connection attempt failed", "attempt", attempt+1, "attempts", run.FTP.Retries+1, "retry_in", delay, "error", err)
+		select {
+		case <-time.After(delay):
+		case <-ctx.Done():
+			return nil, fmt.Errorf("connect cancelled: %w", ctx.Err())
+		}
+		delay *= 2
+	}
+}
+
+// Операция источника с учетом отмены ctx. Операция выполняется в той же
+// горутине: при отмене у соединений источника истекает таймаут (connGroup),
+// и зависшая операция сама завершается ошибкой, которая заменяется на отмену.
+func withCancel[T any](ctx context.Context, op string, fn func() (T, error)) (T, error) {
+	if err := ctx.Err(); err != nil {
+		var zero T
+		return zero, fmt.Errorf("%s cancelled: %w", op, err)
+	}
+	value, err := fn()
+	if err != nil && ctx.Err() != nil {
+		return value, fmt.Errorf("%s cancelled: %w", op, ctx.Err())
+	}
+	return value, err
+}
+
+// Источник, операции которого прерываются при отмене контекста проверки
+// (tick_timeout)
+type ctxSource struct {
+	ctx  context.Context
+	src  FileSource
+	once sync.Once
+}
+
+func withContext(ctx context.Context, src FileSource) *ctxSource {
+	return &ctxSource{ctx: ctx, src: src}
+}
+
+func (s *ctxSource) List(dir string) ([]*ftp.Entry, error) {
+	return withCancel(s.ctx, "list", func() ([]*ftp.Entry, error) {
+		return s.src.List(dir)
+	})
+}
+
+func (s *ctxSource) Retrieve(name string) (io.ReadCloser, error) {
+	r, err := withCancel(s.ctx, "retrieve", func() (io.ReadCloser, error) {
+		return s.src.Retrieve(name)
+	})
+	if err != nil {
+		return nil, err
+	}
+	// Без tick_timeout отмены не бывает, обертка не нужна
+	if s.ctx.Done() == nil {
+		return r, nil
+	}
+	return &ctxReader{ctx: s.ctx, r: r}, nil
+}
+
+func (s *ctxSource) Size(name string) (int64, error) {
+	return withCancel(s.ctx, "size", func() (int64, error) {
+		return s.src.Size(name)
+	})
+}
+
+func (s *ctxSource) ModTime(name string) (time.Time, error) {
+	return withCancel(s.ctx, "modtime", func() (time.Time, error) {
+		return s.src.ModTime(name)
+	})
+}
+
+func (s *ctxSource) Close() error {
+	var err error
+	s.once.Do(func() {
+		err = s.src.Close()
+	})
+	return err
+}
+
+// Скачиваемый файл, ошибка чтения которого после отмены заменяется на отмену
+type ctxReader struct {
+	ctx context.Context
+	r   io.ReadCloser
+}
+
+func (r *ctxReader) Read(p []byte) (int, error) {
+	n, err := r.r.Read(p)
+	if err != nil && err != io.EOF && r.ctx.Err() != nil {
+		return n, fmt.Errorf("download cancelled: %w", r.ctx.Err())
+	}
+	return n, err
+}
+
+func (r *ctxReader) Close() error {
+	return r.r.Close()
+}
+
+// Соединения одного источника. При отмене проверки у всех открытых соединений
+// истекает таймаут: зависшие команды и передачи сразу завершаются ошибкой,
+// и источник закрывается без фоновых горутин.
+type connGroup struct {
+	mu          sync.Mutex
+	conns       map[*groupConn]struct{}
+	interrupted bool
+}
+
+// Регистрация соединения; после отмены таймаут истекает сразу
+func (g *connGroup) add(conn net.Conn) net.Conn {
+	c := &groupConn{Conn: conn, group: g}
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	if g.conns == nil {
+		g.conns = make(map[*groupConn]struct{})
+	}
+	g.conns[c] = struct{}{}
+	if g.interrupted {
+		conn.SetDeadline(time.Now())
+	}
+	return c
+}
+
+// Прерывание операций на всех соединениях группы
+func (g *connGroup) interrupt() {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	g.interrupted = true
+	for c := range g.conns {
+		c.Conn.SetDeadline(time.Now())
+	}
+}
+
+// Соединение группы: после прерывания таймаут больше не продлевается
+type groupConn struct {
+	net.Conn
+	group *connGroup
+}
+
+func (c *groupConn) SetDeadline(t time.Time) error {
+	return c.setDeadline(t, c.Conn.SetDeadline)
+}
+
+func (c *groupConn) SetReadDeadline(t time.Time) error {
+	return c.setDeadline(t, c.Conn.SetReadDeadline)
+}
+
+func (c *groupConn) SetWriteDeadline(t time.Time) error {
+	return c.setDeadline(t, c.Conn.SetWriteDeadline)
+}
+
+func (c *groupConn) setDeadline(t time.Time, set func(time.Time) error) error {
+	c.group.mu.Lock()
+	defer c.group.mu.Unlock()
+	if c.group.interrupted {
+		return nil
+	}
+	return set(t)
+}
+
+func (c *groupConn) Close() error {
+	c.group.mu.Lock()
+	delete(c.group.conns, c)
+	c.group.mu.Unlock()
+	return c.Conn.Close()
+}
+
+// Открытие источника файлов по протоколу из конфигурации
+func dialSource(ctx context.Context, run *checkRun) (FileSource, error) {
+	switch run.FTP.Protocol {
+	case "", "ftp":
+		return connectFTP(ctx, run)
+	case "sftp":
+		return connectSFTP(ctx, run)
+	default:
+		return nil, fmt.Errorf("unsupported protocol %q", run.FTP.Protocol)
+	}
+}
+
+// Файл больше ftp.max_file_bytes
+var errFileTooLarge = errors.New("file exceeds ftp.max_file_bytes")
+
+// Копирование файла с сервера в w. Все скачивания идут через эту функцию:
+// при ftp.max_file_bytes чтение прекращается, как только файл превысит
+// предел, поэтому слишком большой файл не займет память или диск.
+func retrieveTo(cfg *Config, src FileSource, remotePath string, w io.Writer) (int64, error) {
+	reader, err := src.Retrieve(remotePath)
+	if err != nil {
+		return 0, fmt.Errorf("failed to retrieve file: %w", err)
+	}
+	defer reader.Close()
+
+	limit := cfg.FTP.MaxFileBytes
+	if limit <= 0 {
+		n, err := io.Copy(w, reader)
+		if err != nil {
+			return n, fmt.Errorf("failed to copy file content: %w", err)
+		}
+		return n, nil
+	}
+
+	// Лишний байт показывает, что файл длиннее предела
+	n, err := io.Copy(w, io.LimitReader(reader, limit+1))
+	if err != nil {
+		return n, fmt.Errorf("failed to copy file content: %w", err)
+	}
+	if n > limit {
+		return n, fmt.Errorf("%w (%s)", errFileTooLarge, formatSize(limit))
+	}
+	return n, nil
+}
+
+// Предельная глубина обхода, если ftp.max_depth не задан
+const maxRecursionDepth = 32
+
+// Список файлов рабочей директории. При ftp.recursive обходятся и поддиректории,
+// а имена файлов содержат путь относительно рабочей директории.
+func listFiles(run *checkRun, src FileSource) ([]*ftp.Entry, error) {
+	if !run.FTP.Recursive {
+		return src.List("")
+	}
+
+	maxDepth := run.FTP.MaxDepth
+	if maxDepth == 0 {
+		maxDepth = maxRecursionDepth
+	}
+	visited := make(map[string]bool)
+	var files []*ftp.Entry
+	var walk func(dir string, depth int) error
+	walk = func(dir string, depth int) error {
+		// Защита от повторного обхода одной директории
+		if visited[dir] {
+			return nil
+		}
+		visited[dir] = true
+
+		entries, err := src.List(dir)
+		if err != nil {
+			return fmt.Errorf("failed to list %q: %w", dir, err)
+		}
+		for _, entry := range entries {
+			if entry.Name == "." || entry.Name == ".." {
+				continue
+			}
+			name := path.Join(dir, path.Base(entry.Name))
+			switch entry.Type {
+			case ftp.EntryTypeFile:
+				entry.Name = name
+				files = append(files, entry)
+			case ftp.EntryTypeFolder:
+				if depth >= maxDepth {
+					run.log.Warn("Maximum directory depth reached, skipping", "dir", name, "max_depth", maxDepth)
+					continue
+				}
+				if err := walk(name, depth+1); err != nil {
+					return err
+				}
+			default:
+				// Символические ссылки не разыменовываются, чтобы не зациклиться
+				run.log.Debug("Skipping symbolic link", "path", name)
+			}
+		}
+		return nil
+	}
+
+	if err := walk("", 0); err != nil {
+		return nil, err
+	}
+	return files, nil
+}
+
+// Операции FTP-клиента, которые использует уведомитель. Позволяет подменить
+// клиент, например, на поддельный в тестах.
+type FTPClient interface {
+	Login(user, password string) error
+	ChangeDir(path string) error
+	CurrentDir() (string, error)
+	List(path string) ([]*ftp.Entry, error)
+	Retr(path string) (io.ReadCloser, error)
+	FileSize(path string) (int64, error)
+	IsGetTimeSupported() bool
+	GetTime(path string) (time.Time, error)
+	NoOp() error
+	Quit() error
+}
+
+// Создание FTP-клиента; по умолчанию - подключение через jlaffaye/ftp
+var dialFTP = func(addr string, options ...ftp.DialOption) (FTPClient, error) {
+	conn, err := ftp.Dial(addr, options...)
+	if err != nil {
+		return nil, err
+	}
+	return &serverConn{conn}, nil
+}
+
+// Соединение jlaffaye/ftp; передача файла не ограничена по времени,
+// зависшая загрузка прерывается отменой контекста проверки
+type serverConn struct {
+	*ftp.ServerConn
+}
+
+func (c *serverConn) Retr(path string) (io.ReadCloser, error) {
+	return c.ServerConn.Retr(path)
+}
+
+// Выполнение fn для индексов 0..n-1 не более чем в workers потоков. Первый поток
+// использует src, остальные открывают собственные соединения, так как FTP
+// не допускает параллельных передач через одно соединение. Первая ошибка
+// прекращает выдачу новых индексов.
+func parallelWithSources(ctx context.Context, run *checkRun, src FileSource, workers, n int, fn func(conn FileSource, i int) error) error {
+	workers = min(max(workers, 1), n)
+	indexes := make(chan int)
+	g, gctx := errgroup.WithContext(ctx)
+
+	for w := 0; w < workers; w++ {
+		g.Go(func() error {
+			conn := src
+			if w > 0 {
+				extra, err := openSource(ctx, run)
+				if err != nil {
+					return fmt.Errorf("error connecting to FTP: %w", err)
+				}
+				defer extra.Close()
+				conn = extra
+			}
+			for i := range indexes {
+				if err := fn(conn, i); err != nil {
+					return err
+				}
+			}
+			return nil
+		})
+	}
+
+	g.Go(func() error {
+		defer close(indexes)
+		for i := 0; i < n; i++ {
+			select {
+			case indexes <- i:
+			case <-gctx.Done():
+				return nil
+			}
+		}
+		return nil
+	})
+	return g.Wait()
+}
+
+// Источник файлов на FTP-сервере
+type ftpSource struct {
+	conn FTPClient
+	// Проверка, открывшая соединение: ограничение частоты команд и лог
+	run *checkRun
+	// Абсолютный путь рабочей директории; пустой, если сервер не сообщил его
+	dir string
+	// Команды управляющего соединения не пересекаются с NOOP поддержки
+	// соединения; при скачивании блокировка держится до закрытия файла
+	mu   sync.Mutex
+	done chan struct{}
+	// Отмена прерывания соединений по контексту проверки
+	stop func() bool
+	// Выполняется RETR: соединение данных открывается с таймаутом
+	// ftp.download_timeout; меняется под mu
+	download *bool
+}
+
+// Список передается с явным путем: на некоторых серверах LIST без аргумента
+// возвращает корень, а не текущую директорию
+func (s *ftpSource) List(dir string) ([]*ftp.Entry, error) {
+	waitFTPRate(s.run, "list")
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	target := path.Join(s.dir, dir)
+	if target == "" {
+		target = "."
+	}
+	entries, err := s.conn.List(target)
+	if err == nil && !listedItself(entries, target) {
+		return entries, nil
+	}
+
+	// Часть серверов показывает содержимое директории, только если путь
+	// заканчивается на "/", а иначе возвращает ошибку или саму директорию
+	s.run.log.Debug("Retrying listing with trailing slash", "dir", target, "error", err)
+	waitFTPRate(s.run, "list")
+	retry, retryErr := s.conn.List(strings.TrimSuffix(target, "/") + "/")
+	if retryErr != nil && err != nil {
+		return nil, err
+	}
+	return retry, retryErr
+}
+
+// Список из одной записи - самой директории dir вместо ее содержимого
+func listedItself(entries []*ftp.Entry, dir string) bool {
+	return len(entries) == 1 &&
+		entries[0].Type == ftp.EntryTypeFolder &&
+		path.Base(entries[0].Name) == path.Base(dir)
+}
+
+func (s *ftpSource) Retrieve(name string) (io.ReadCloser, error) {
+	waitFTPRate(s.run, "retr")
+	s.mu.Lock()
+	*s.download = true
+	r, err := s.conn.Retr(name)
+	*s.download = false
+	if err != nil {
+		s.mu.Unlock()
+		return nil, err
+	}
+	return &unlockReader{ReadCloser: r, mu: &s.mu}, nil
+}
+
+func (s *ftpSource) Size(name string) (int64, error) {
+	waitFTPRate(s.run, "size")
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.conn.FileSize(name)
+}
+
+func (s *ftpSource) ModTime(name string) (time.Time, error) {
+	waitFTPRate(s.run, "mdtm")
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if !s.conn.IsGetTimeSupported() {
+		return time.Time{}, errors.ErrUnsupported
+	}
+	return s.conn.GetTime(name)
+}
+
+func (s *ftpSource) Close() error {
+	s.stop()
+	if s.done != nil {
+		close(s.done)
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.conn.Quit()
+}
+
+// Поддержка управляющего соединения командой NOOP раз в interval, пока оно
+// простаивает, например во время отправки писем или загрузок через другие
+// соединения. Во время передачи данных NOOP не отправляется: ответ на него
+// перемешался бы с ответом о завершении передачи.
+func (s *ftpSource) keepAlive(interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-s.done:
+			return
+		case <-ticker.C:
+			if !s.mu.TryLock() {
+				continue
+			}
+			err := s.conn.NoOp()
+			s.mu.Unlock()
+			if err != nil {
+				s.run.log.Debug("FTP keep-alive failed", "error", err)
+			}
+		}
+	}
+}
+
+// Скачиваемый файл, при закрытии освобождающий управляющее соединение
+type unlockReader struct {
+	io.ReadCloser
+	mu   *sync.Mutex
+	once sync.Once
+}
+
+func (r *unlockReader) Close() error {
+	err := r.ReadCloser.Close()
+	r.once.Do(r.mu.Unlock)
+	return err
+}
+
+// Подключение к FTP-серверу, авторизация и переход в рабочую директорию.
+// При отмене ctx у соединений истекает таймаут, в том числе во время входа.
+func connectFTP(ctx context.Context, run *checkRun) (_ *ftpSource, err error) {
+	conns := &connGroup{}
+	stop := context.AfterFunc(ctx, conns.interrupt)
+	defer func() {
+		if err != nil {
+			stop()
+		}
+	}()
+
+	download := new(bool)
+	conn, err := dialFTP(ftpAddress(run.Config), ftpDialOptions(run.Config, conns, download)...)
+	if err != nil {
+		return nil, fmt.Errorf("failed to connect to FTP server: %w", err)
+	}
+
+	// Авторизация
+	waitFTPRate(run, "login")
+	err = conn.Login(run.FTP.User, run.FTP.Password)
+	if err != nil {
+		conn.Quit()
+		return nil, fmt.Errorf("failed to login to FTP server: %w", err)
+	}
+
+	// Переход в директорию; без ftp.dir остается директория по умолчанию после входа
+	if run.FTP.Dir != "" {
+		waitFTPRate(run, "cwd")
+		err = conn.ChangeDir(run.FTP.Dir)
+		if err != nil {
+			conn.Quit()
+			return nil, fmt.Errorf("failed to change directory: %w", err)
+		}
+	}
+
+	// Путь нужен для явного указания директории в LIST
+	dir, err := conn.CurrentDir()
+	if err != nil {
+		run.log.Debug("Failed to get current directory, listing relative paths", "error", err)
+		dir = ""
+	}
+
+	src := &ftpSource{conn: conn, run: run, dir: dir, stop: stop, download: download}
+	if run.FTP.KeepaliveInterval > 0 {
+		src.done = make(chan struct{})
+		go src.keepAlive(run.FTP.KeepaliveInterval)
+	}
+	return src, nil
+}
+
+// Таймаут подключения к серверу
+func dialTimeout(cfg *Config) time.Duration {
+	if cfg.FTP.DialTimeout > 0 {
+		return cfg.FTP.DialTimeout
+	}
+	return 5 * time.Second
+}
+
+// Таймаут подключения для скачивания файла (соединение данных RETR)
+func downloadTimeout(cfg *Config) time.Duration {
+	if cfg.FTP.DownloadTimeout > 0 {
+		return cfg.FTP.DownloadTimeout
+	}
+	return 30 * time.Second
+}
+
+// Адрес сервера; если порт не задан, используется стандартный для протокола
+func ftpAddress(cfg *Config) string {
+	port := cfg.FTP.Port
+	if port == 0 {
+		port = 21
+		if cfg.FTP.Protocol == "sftp" {
+			port = 22
+		}
+	}
+	return net.JoinHostPort(cfg.FTP.Server, strconv.Itoa(port))
+}
+
+// Опции подключения к FTP-серверу с учетом настроек TLS. Соединения
+// открывает ftpDialFunc и регистрирует в conns.
+func ftpDialOptions(cfg *Config, conns *connGroup, download *bool) []ftp.DialOption {
+	var options []ftp.DialOption
+	// Соединения данных всегда пассивные; EPSV можно отключить для серверов
+	// и межсетевых экранов, которые поддерживают только PASV
+	if cfg.FTP.DisableEPSV {
+		options = append(options, ftp.DialWithDisabledEPSV(true))
+	}
+	if cfg.FTP.Proxy != "" {
+		// Имя хоста разрешает прокси, поэтому IP сервера для EPSV неизвестен;
+		// PASV сообщает адрес для соединения данных явно
+		if net.ParseIP(cfg.FTP.Server) == nil {
+			options = append(options, ftp.DialWithDisabledEPSV(true))
+		}
+	}
+	if !cfg.FTP.TLS {
+		return append(options, ftp.DialWithDialFunc(ftpDialFunc(cfg, conns, nil, download)))
+	}
+
+	tlsConfig := &tls.Config{
+		ServerName:         cfg.FTP.Server,
+		InsecureSkipVerify: cfg.FTP.TLSSkipVerify,
+	}
+	// Явный TLS (AUTH TLS) используется по умолчанию, неявный - только по запросу
+	if explicitTLS(cfg) {
+		options = append(options, ftp.DialWithExplicitTLS(tlsConfig))
+	} else {
+		options = append(options, ftp.DialWithTLS(tlsConfig))
+	}
+	return append(options, ftp.DialWithDialFunc(ftpDialFunc(cfg, conns, tlsConfig, download)))
+}
+
+// Явный TLS (AUTH TLS) при ftp.tls
+func explicitTLS(cfg *Config) bool {
+	return cfg.FTP.TLSExplicit == nil || *cfg.FTP.TLSExplicit
+}
+
+// Функция подключения для jlaffaye/ftp: соединения открываются через ftp.proxy
+// или напрямую и регистрируются в conns. Первое соединение - управляющее
+// (при ftp.account оно перехватывает запрос учетной записи), остальные -
+// соединения данных; при *download (RETR) они открываются с таймаутом
+// скачивания. jlaffaye/ftp не устанавливает TLS поверх собственной
+// функции подключения, поэтому неявный TLS и TLS данных добавляются здесь;
+// AUTH TLS на управляющем соединении выполняет сам клиент.
+func ftpDialFunc(cfg *Config, conns *connGroup, tlsConfig *tls.Config, download *bool) func(network, addr string) (net.Conn, error) {
+	control := true
+	return func(network, addr string) (net.Conn, error) {
+		timeout := dialTimeout(cfg)
+		if !control && *download {
+			timeout = downloadTimeout(cfg)
+		}
+		conn, err := dialServer(cfg, network, addr, timeout)
+		if err != nil {
+			return nil, err
+		}
+		conn = conns.add(conn)
+		if control {
+			control = false
+			if cfg.FTP.Account != "" {
+				conn = withAccount(conn, cfg.FTP.Account)
+			}
+			if tlsConfig != nil && !explicitTLS(cfg) {
+				conn = tls.Client(conn, tlsConfig)
+			}
+			return conn, nil
+		}
+		if tlsConfig != nil {
+			conn = tls.Client(conn, tlsConfig)
+		}
+		return conn, nil
+	}
+}
@@ -0,0 +1,142 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"io"
+	"path"
+	"slices"
+	"testing"
+	"time"
+
+	"github.com/jlaffaye/ftp"
+)
+
+// Поддельный FTP-клиент: содержимое директорий по абсолютному пути
+// и время изменения файлов для MDTM
+type fakeFTPClient struct {
+	dir     string
+	entries map[string][]*ftp.Entry
+	times   map[string]time.Time
+}
+
+func (c *fakeFTPClient) Login(user, password string) error { return nil }
+func (c *fakeFTPClient) ChangeDir(dir string) error {
+	if _, ok := c.entries[dir]; !ok {
+		return errors.New("550 no such directory")
+	}
+	c.dir = dir
+	return nil
+}
+func (c *fakeFTPClient) CurrentDir() (string, error) { return c.dir, nil }
+
+// Записи копируются: listFiles переписывает имена найденных файлов
+func (c *fakeFTPClient) List(dir string) ([]*ftp.Entry, error) {
+	entries, ok := c.entries[path.Clean(dir)]
+	if !ok {
+		return nil, errors.New("550 no such directory")
+	}
+	var list []*ftp.Entry
+	for _, entry := range entries {
+		copied := *entry
+		list = append(list, &copied)
+	}
+	return list, nil
+}
+func (c *fakeFTPClient) Retr(string) (io.ReadCloser, error) { return nil, errors.ErrUnsupported }
+func (c *fakeFTPClient) FileSize(string) (int64, error)     { return 0, errors.ErrUnsupported }
+func (c *fakeFTPClient) IsGetTimeSupported() bool           { return true }
+func (c *fakeFTPClient) GetTime(name string) (time.Time, error) {
+	modified, ok := c.times[path.Join(c.dir, name)]
+	if !ok {
+		return time.Time{}, errors.New("550 no such file")
+	}
+	return modified, nil
+}
+func (c *fakeFTPClient) NoOp() error { return nil }
+func (c *fakeFTPClient) Quit() error { return nil }
+
+// Подмена клиента на поддельный до конца теста
+func useFakeFTP(t *testing.T, client *fakeFTPClient) {
+	t.Helper()
+	dial := dialFTP
+	dialFTP = func(string, ...ftp.DialOption) (FTPClient, error) { return client, nil }
+	t.Cleanup(func() { dialFTP = dial })
+}
+
+// Отбор новых файлов: маски, пропуск директорий и ссылок, уже отправленные файлы
+func TestGetNewFilesFromFTP(t *testing.T) {
+	modified := time.Date(2024, 1, 2, 10, 30, 0, 0, time.UTC)
+	file := func(name string) *ftp.Entry {
+		return &ftp.Entry{Name: name, Type: ftp.EntryTypeFile, Size: 100, Time: modified}
+	}
+	newClient := func() *fakeFTPClient {
+		return &fakeFTPClient{
+			dir: "/",
+			entries: map[string][]*ftp.Entry{
+				"/": {{Name: "releases", Type: ftp.EntryTypeFolder}},
+				"/releases": {
+					file("app.json"),
+					file("sent.json"),
+					file("notes.txt"),
+					file("app.json.tmp"),
+					{Name: "nested.json", Type: ftp.EntryTypeFolder},
+					{Name: "latest.json", Type: ftp.EntryTypeLink, Target: "app.json"},
+				},
+				"/releases/nested.json": {
+					file("inner.json"),
+					file("inner.txt"),
+				},
+			},
+			times: map[string]time.Time{
+				"/releases/app.json":               modified,
+				"/releases/sent.json":              modified,
+				"/releases/notes.txt":              modified,
+				"/releases/app.json.tmp":           modified,
+				"/releases/nested.json/inner.json": modified,
+				"/releases/nested.json/inner.txt":  modified,
+			},
+		}
+	}
+
+	tests := []struct {
+		name      string
+		recursive bool
+		want      []string
+	}{
+		{name: "flat", want: []string{"app.json"}},
+		{name: "recursive", recursive: true, want: []string{"app.json", "nested.json/inner.json"}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			run := setupSentLog(t)
+			config.FTP.Dir = "/releases"
+			config.FTP.Pattern = "*.json"
+			config.FTP.Recursive = tt.recursive
+			useFakeFTP(t, newClient())
+
+			src, err := connectFTP(context.Background(), run)
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer src.Close()
+
+			sent := ftp.Entry{Name: "sent.json", Type: ftp.EntryTypeFile, Size: 100}
+			sent.Time = preciseModTime(run, src, &sent)
+			markFilesAsSent([]sentRecord{newSentRecord(run, sent, nil)})
+
+			files, err := getNewFilesFromFTP(run, src)
+			if err != nil {
+				t.Fatal(err)
+			}
+			var names []string
+			for _, f := range files {
+				names = append(names, f.Name)
+			}
+			slices.Sort(names)
+			if !slices.Equal(names, tt.want) {
+				t.Errorf("new files = %q, want %q", names, tt.want)
+			}
+		})
+	}
+}
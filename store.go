@@ -0,0 +1,738 @@
+package main
+
+import (
+	"bufio"
+	"crypto/sha256"
+	"database/sql"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/jlaffaye/ftp"
+	_ "modernc.org/sqlite"
+)
+
+const sentFilesLog = "sent_files.log"
+
+const sentFilesDB = "sent_files.db"
+
+const highwaterFile = "highwater.state"
+
+// Хранилище отметок об отправленных файлах
+type sentStore interface {
+	IsSent(record sentRecord) (bool, error)
+	MarkSent(records []sentRecord) error
+	// Удаление отметок с датой модификации раньше cutoff (YYYY-MM-DD)
+	Prune(cutoff string) (int, error)
+	Close() error
+}
+
+// Отметка об отправленном файле. Date - точное время изменения файла в UTC
+// (RFC 3339); только дата - в отметках прежних версий и если сервер не
+// поддерживает MDTM; пусто, если сервер не сообщает время. Hash заполняется
+// только при state.dedup: hash, Size - при state.dedup: name_size и для
+// файлов без времени изменения.
+// SentAt - время отправки письма (RFC 3339); в сравнении не участвует.
+type sentRecord struct {
+	Name   string
+	Date   string
+	Hash   string
+	Size   int64
+	SentAt string
+	// Путь файла на сервере; в хранилище не записывается
+	Path string
+	// Задание, к которому относится отметка (для highwater); в хранилище не записывается
+	Job string
+}
+
+// Отметка для файла; content нужен только для дедупликации по содержимому
+func newSentRecord(run *checkRun, file ftp.Entry, content []byte) sentRecord {
+	record := sentRecord{
+		Name: recordName(run.Name, file.Name),
+		Date: file.Time.UTC().Format(time.RFC3339),
+		Path: file.Name,
+		Job:  run.Name,
+	}
+	// Отметка highwater сравнивается только с точным временем
+	if !highwaterMode() {
+		switch run.state.precision[file.Name] {
+		case timeListed:
+			// Дата берется в часовом поясе списка: в UTC полночь старого
+			// файла могла бы оказаться предыдущим днем
+			record.Date = file.Time.Format("2006-01-02")
+		case timeUnknown:
+			// Время первого обнаружения меняется после перезапуска
+			record.Date = ""
+			record.Size = int64(file.Size)
+		}
+	}
+	if dedupByHash() && content != nil {
+		sum := sha256.Sum256(content)
+		record.Hash = hex.EncodeToString(sum[:])
+	}
+	if config.State.Dedup == "name_size" {
+		record.Size = int64(file.Size)
+	}
+	return record
+}
+
+// Имя файла в отметках. Отметки заданий различаются префиксом "задание:",
+// чтобы одинаковые имена файлов на разных серверах не смешивались.
+func recordName(job, name string) string {
+	if job == "" {
+		return name
+	}
+	return job + ":" + name
+}
+
+// Дедупликация по SHA-256 содержимого вместо имени и даты модификации
+func dedupByHash() bool {
+	return config.State.Dedup == "hash"
+}
+
+// Учет по наибольшему времени изменения вместо отметки на каждый файл
+func highwaterMode() bool {
+	return config.State.Mode == "highwater"
+}
+
+// Текущее хранилище, открывается при запуске
+var store sentStore
+
+// Открытие хранилища по state.backend: file (по умолчанию) или sqlite;
+// при state.mode: highwater - файл с отметкой времени
+func openStore() (sentStore, error) {
+	logPath := config.State.SentFilesPath
+	if logPath == "" {
+		logPath = sentFilesLog
+	}
+
+	if highwaterMode() {
+		path := config.State.HighwaterPath
+		if path == "" {
+			path = highwaterFile
+		}
+		if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+			return nil, fmt.Errorf("failed to create highwater state directory: %w", err)
+		}
+		return &highwaterStore{path: path}, nil
+	}
+
+	switch config.State.Backend {
+	case "", "file":
+		if err := os.MkdirAll(filepath.Dir(logPath), 0755); err != nil {
+			return nil, fmt.Errorf("failed to create sent files directory: %w", err)
+		}
+		s := &logStore{path: logPath}
+		if err := s.migrate(); err != nil {
+			return nil, err
+		}
+		return s, nil
+	case "sqlite":
+		path := config.State.SQLitePath
+		if path == "" {
+			path = sentFilesDB
+		}
+		if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+			return nil, fmt.Errorf("failed to create sent files directory: %w", err)
+		}
+		return openSQLiteStore(path, logPath)
+	default:
+		return nil, fmt.Errorf("unsupported state backend %q", config.State.Backend)
+	}
+}
+
+// Маркировка файлов как отправленных. Вызывается один раз в конце проверки для
+// всех успешно отправленных групп, поэтому доставка "хотя бы один раз": при сбое
+// между отправкой и записью отметки письмо будет отправлено повторно, но не потеряно.
+func markFilesAsSent(records []sentRecord) {
+	if len(records) == 0 {
+		return
+	}
+	// Повторная отправка без -mark журнал не меняет
+	if backfill.window > 0 && !backfill.mark {
+		return
+	}
+	sentAt := time.Now().UTC().Format(time.RFC3339)
+	for i := range records {
+		records[i].SentAt = sentAt
+	}
+	if err := store.MarkSent(records); err != nil {
+		slog.Error("Failed to mark files as sent", "count", len(records), "error", err)
+	}
+}
+
+// Проверка, был ли файл уже отправлен
+func isFileAlreadySent(record sentRecord) bool {
+	sent, err := store.IsSent(record)
+	if err != nil {
+		slog.Error("Failed to check sent state", "file", record.Name, "error", err)
+		return false
+	}
+	return sent
+}
+
+// Граница хранения отметок: файлы с датой раньше нее не учитываются
+// и их отметки удаляются. Пустая строка - хранить бессрочно.
+func retentionCutoff() string {
+	if config.State.RetentionDays <= 0 {
+		return ""
+	}
+	return time.Now().AddDate(0, 0, -config.State.RetentionDays).Format("2006-01-02")
+}
+
+// Удаление устаревших отметок согласно state.retention_days
+func pruneSentFiles() {
+	cutoff := retentionCutoff()
+	if cutoff == "" || dryRun {
+		return
+	}
+	removed, err := store.Prune(cutoff)
+	if err != nil {
+		slog.Error("Failed to prune sent files", "error", err)
+		return
+	}
+	if removed > 0 {
+		slog.Info("Pruned sent file records", "count", removed, "cutoff", cutoff)
+	}
+}
+
+// Заголовок журнала текущей версии. Журнал v2 - строки JSON с полями name,
+// date, hash, size и sent_at; журнал без заголовка (v1) - строки
+// "имя|дата[|sha256[|размер]]", он обновляется до v2 при открытии.
+const sentFilesLogHeader = "#v2"
+
+// Отметка в журнале v2; новые поля добавляются с omitempty
+type logRecord struct {
+	Name   string `json:"name"`
+	Date   string `json:"date"`
+	Hash   string `json:"hash,omitempty"`
+	Size   int64  `json:"size,omitempty"`
+	SentAt string `json:"sent_at,omitempty"`
+}
+
+// Хранилище в текстовом файле: заголовок версии и по строке на файл
+type logStore struct {
+	// Исключает дозапись в журнал во время его перезаписи при очистке
+	mu   sync.Mutex
+	path string
+}
+
+// Запись отметок атомарна: журнал переписывается целиком через временный файл,
+// поэтому при сбое в нем не остается частично записанных строк.
+func (s *logStore) MarkSent(records []sentRecord) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	content, err := os.ReadFile(s.path)
+	if err != nil && !os.IsNotExist(err) {
+		return fmt.Errorf("failed to read sent files log: %w", err)
+	}
+	if len(content) == 0 {
+		content = []byte(sentFilesLogHeader + "\n")
+	}
+	if content[len(content)-1] != '\n' {
+		content = append(content, '\n')
+	}
+
+	for _, record := range records {
+		line, err := encodeLogRecord(record)
+		if err != nil {
+			return err
+		}
+		content = append(content, line+"\n"...)
+	}
+	return writeFileAtomic(s.path, content)
+}
+
+// Строка журнала v2 для отметки
+func encodeLogRecord(record sentRecord) (string, error) {
+	line, err := json.Marshal(logRecord{Name: record.Name, Date: record.Date, Hash: record.Hash, Size: record.Size, SentAt: record.SentAt})
+	if err != nil {
+		return "", fmt.Errorf("failed to encode sent file record: %w", err)
+	}
+	return string(line), nil
+}
+
+// Обновление журнала v1 до текущей версии: строки переписываются в JSON
+// под заголовком версии. Журнал неизвестной (более новой) версии не читается.
+func (s *logStore) migrate() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	content, err := os.ReadFile(s.path)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return fmt.Errorf("failed to read sent files log: %w", err)
+	}
+	if len(content) == 0 {
+		return nil
+	}
+	firstLine, _, _ := strings.Cut(string(content), "\n")
+	firstLine = strings.TrimSpace(firstLine)
+	if firstLine == sentFilesLogHeader {
+		return nil
+	}
+	if strings.HasPrefix(firstLine, "#v") {
+		return fmt.Errorf("sent files log %s has unsupported version %s", s.path, firstLine)
+	}
+
+	upgraded := []byte(sentFilesLogHeader + "\n")
+	migrated := 0
+	for _, line := range strings.Split(string(content), "\n") {
+		record, ok := parseSentRecord(line)
+		if !ok {
+			continue
+		}
+		encoded, err := encodeLogRecord(record)
+		if err != nil {
+			return err
+		}
+		upgraded = append(upgraded, encoded+"\n"...)
+		migrated++
+	}
+	if err := writeFileAtomic(s.path, upgraded); err != nil {
+		return err
+	}
+	slog.Info("Upgraded sent files log", "path", s.path, "version", sentFilesLogHeader, "count", migrated)
+	return nil
+}
+
+func (s *logStore) IsSent(record sentRecord) (bool, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	fileLog, err := os.Open(s.path)
+	if err != nil {
+		return false, nil
+	}
+	defer fileLog.Close()
+
+	scanner := bufio.NewScanner(fileLog)
+	for scanner.Scan() {
+		if stored, ok := parseSentRecord(scanner.Text()); ok && stored.matches(record) {
+			return true, nil
+		}
+	}
+	return false, nil
+}
+
+// Разбор строки журнала: JSON (v2) или "имя|дата[|sha256[|размер]]" (v1).
+// Пустые строки и строки-комментарии, включая заголовок версии, пропускаются.
+func parseSentRecord(line string) (sentRecord, bool) {
+	line = strings.TrimSpace(line)
+	if line == "" || strings.HasPrefix(line, "#") {
+		return sentRecord{}, false
+	}
+	if strings.HasPrefix(line, "{") {
+		var stored logRecord
+		if err := json.Unmarshal([]byte(line), &stored); err != nil {
+			slog.Warn("Skipping malformed sent files log line", "line", line, "error", err)
+			return sentRecord{}, false
+		}
+		return sentRecord{Name: stored.Name, Date: stored.Date, Hash: stored.Hash, Size: stored.Size, SentAt: stored.SentAt}, true
+	}
+
+	fields := strings.Split(line, "|")
+	record := sentRecord{Name: fields[0]}
+	if len(fields) > 1 {
+		record.Date = fields[1]
+	}
+	if len(fields) > 2 {
+		record.Hash = fields[2]
+	}
+	if len(fields) > 3 {
+		record.Size, _ = strconv.ParseInt(fields[3], 10, 64)
+	}
+	return record, true
+}
+
+// Совпадение сохраненной отметки с проверяемой: по содержимому,
+// если у проверяемой есть хэш, по имени (и размеру) при state.dedup: name
+// и name_size, иначе по дате модификации, а без нее - по размеру.
+// Отметка с точным временем и отметка только с датой совпадают по дню.
+func (r sentRecord) matches(other sentRecord) bool {
+	if r.Name != other.Name {
+		return false
+	}
+	if other.Hash != "" {
+		return r.Hash == other.Hash
+	}
+	switch config.State.Dedup {
+	case "name":
+		return true
+	case "name_size":
+		// Отметки без размера (до включения name_size) совпадают по имени
+		return r.Size == 0 || r.Size == other.Size
+	}
+	if other.Date == "" {
+		return r.Date == "" && r.Size == other.Size
+	}
+	return r.Date == other.Date || r.Date == legacyDate(other.Date) || legacyDate(r.Date) == other.Date
+}
+
+// Дата в формате отметок прежних версий, которые хранили только день изменения
+func legacyDate(date string) string {
+	if len(date) < len("2006-01-02") {
+		return date
+	}
+	return date[:len("2006-01-02")]
+}
+
+// Перезапись журнала без устаревших строк: новый файл пишется рядом
+// и атомарно заменяет старый
+func (s *logStore) Prune(cutoff string) (int, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	content, err := os.ReadFile(s.path)
+	if os.IsNotExist(err) {
+		return 0, nil
+	}
+	if err != nil {
+		return 0, fmt.Errorf("failed to read sent files log: %w", err)
+	}
+
+	var kept []byte
+	removed := 0
+	for _, line := range strings.Split(string(content), "\n") {
+		if line == "" {
+			continue
+		}
+		if record, ok := parseSentRecord(line); ok && record.Date != "" && record.Date < cutoff {
+			removed++
+			continue
+		}
+		kept = append(kept, line+"\n"...)
+	}
+	if removed == 0 {
+		return 0, nil
+	}
+
+	if err := writeFileAtomic(s.path, kept); err != nil {
+		return 0, err
+	}
+	return removed, nil
+}
+
+// Замена файла: данные пишутся во временный файл рядом, сбрасываются на диск
+// и атомарно переименовываются поверх старого
+func writeFileAtomic(path string, data []byte) error {
+	tmpPath := path + ".tmp"
+	file, err := os.OpenFile(tmpPath, os.O_CREATE|os.O_TRUNC|os.O_WRONLY, 0644)
+	if err != nil {
+		return fmt.Errorf("failed to write sent files log: %w", err)
+	}
+	if _, err := file.Write(data); err != nil {
+		file.Close()
+		return fmt.Errorf("failed to write sent files log: %w", err)
+	}
+	if err := file.Sync(); err != nil {
+		file.Close()
+		return fmt.Errorf("failed to sync sent files log: %w", err)
+	}
+	if err := file.Close(); err != nil {
+		return fmt.Errorf("failed to write sent files log: %w", err)
+	}
+	if err := os.Rename(tmpPath, path); err != nil {
+		return fmt.Errorf("failed to replace sent files log: %w", err)
+	}
+
+	// Переименование сохраняется на диске только после синхронизации директории
+	if dir, err := os.Open(filepath.Dir(path)); err == nil {
+		dir.Sync()
+		dir.Close()
+	}
+	return nil
+}
+
+func (s *logStore) Close() error {
+	return nil
+}
+
+// Хранилище в SQLite: поиск по первичному ключу вместо просмотра всего журнала
+type sqliteStore struct {
+	db *sql.DB
+}
+
+// Открытие базы SQLite через драйвер на чистом Go (modernc.org/sqlite),
+// чтобы сборка не требовала cgo. При создании таблицы в нее переносятся
+// записи из существующего текстового журнала.
+func openSQLiteStore(path, legacyLog string) (*sqliteStore, error) {
+	db, err := sql.Open("sqlite", path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open sent files database: %w", err)
+	}
+
+	var tables int
+	err = db.QueryRow(`SELECT count(*) FROM sqlite_master WHERE type = 'table' AND name = 'sent_files'`).Scan(&tables)
+	if err != nil {
+		db.Close()
+		return nil, fmt.Errorf("failed to inspect sent files database: %w", err)
+	}
+
+	_, err = db.Exec(`CREATE TABLE IF NOT EXISTS sent_files (
+		name     TEXT NOT NULL,
+		mod_date TEXT NOT NULL,
+		hash     TEXT NOT NULL DEFAULT '',
+		size     INTEGER NOT NULL DEFAULT 0,
+		sent_at  TEXT NOT NULL DEFAULT '',
+		PRIMARY KEY (name, mod_date, hash, size)
+	)`)
+	if err != nil {
+		db.Close()
+		return nil, fmt.Errorf("failed to create sent files table: %w", err)
+	}
+
+	// Столбцы size и sent_at появились позже; в базы прежних версий они добавляются
+	for _, column := range []struct{ name, definition string }{
+		{"size", "INTEGER NOT NULL DEFAULT 0"},
+		{"sent_at", "TEXT NOT NULL DEFAULT ''"},
+	} {
+		if err := addColumnIfMissing(db, column.name, column.definition); err != nil {
+			db.Close()
+			return nil, fmt.Errorf("failed to upgrade sent files table: %w", err)
+		}
+	}
+	if err := addSizeToKey(db); err != nil {
+		db.Close()
+		return nil, fmt.Errorf("failed to upgrade sent files table: %w", err)
+	}
+
+	s := &sqliteStore{db: db}
+	if tables == 0 {
+		if err := s.importLog(legacyLog); err != nil {
+			db.Close()
+			return nil, err
+		}
+	}
+	return s, nil
+}
+
+// Добавление столбца в таблицу sent_files, если его еще нет
+func addColumnIfMissing(db *sql.DB, name, definition string) error {
+	var columns int
+	err := db.QueryRow(`SELECT count(*) FROM pragma_table_info('sent_files') WHERE name = ?`, name).Scan(&columns)
+	if err != nil || columns > 0 {
+		return err
+	}
+	_, err = db.Exec(`ALTER TABLE sent_files ADD COLUMN ` + name + ` ` + definition)
+	return err
+}
+
+// Размер входит в первичный ключ: иначе отметка файла без времени изменения
+// с новым размером совпала бы со старой и не была бы записана. Таблица прежних
+// версий с ключом (name, mod_date, hash) пересоздается с переносом записей.
+func addSizeToKey(db *sql.DB) error {
+	var inKey int
+	err := db.QueryRow(`SELECT count(*) FROM pragma_table_info('sent_files') WHERE name = 'size' AND pk > 0`).Scan(&inKey)
+	if err != nil || inKey > 0 {
+		return err
+	}
+
+	tx, err := db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+	for _, stmt := range []string{
+		`CREATE TABLE sent_files_new (
+			name     TEXT NOT NULL,
+			mod_date TEXT NOT NULL,
+			hash     TEXT NOT NULL DEFAULT '',
+			size     INTEGER NOT NULL DEFAULT 0,
+			sent_at  TEXT NOT NULL DEFAULT '',
+			PRIMARY KEY (name, mod_date, hash, size)
+		)`,
+		`INSERT INTO sent_files_new (name, mod_date, hash, size, sent_at)
+			SELECT name, mod_date, hash, size, sent_at FROM sent_files`,
+		`DROP TABLE sent_files`,
+		`ALTER TABLE sent_files_new RENAME TO sent_files`,
+	} {
+		if _, err := tx.Exec(stmt); err != nil {
+			return err
+		}
+	}
+	return tx.Commit()
+}
+
+// Перенос записей из текстового журнала, если он есть. Отметки без даты
+// (сервер не сообщает время) переносятся вместе с размером.
+func (s *sqliteStore) importLog(path string) error {
+	file, err := os.Open(path)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return fmt.Errorf("failed to open sent files log: %w", err)
+	}
+	defer file.Close()
+
+	tx, err := s.db.Begin()
+	if err != nil {
+		return fmt.Errorf("failed to import sent files log: %w", err)
+	}
+	defer tx.Rollback()
+
+	imported := 0
+	scanner := bufio.NewScanner(file)
+	for scanner.Scan() {
+		record, ok := parseSentRecord(scanner.Text())
+		if !ok {
+			continue
+		}
+		_, err := tx.Exec(`INSERT OR IGNORE INTO sent_files (name, mod_date, hash, size, sent_at) VALUES (?, ?, ?, ?, ?)`, record.Name, record.Date, record.Hash, record.Size, record.SentAt)
+		if err != nil {
+			return fmt.Errorf("failed to import sent files log: %w", err)
+		}
+		imported++
+	}
+	if err := scanner.Err(); err != nil {
+		return fmt.Errorf("failed to read sent files log: %w", err)
+	}
+	if err := tx.Commit(); err != nil {
+		return fmt.Errorf("failed to import sent files log: %w", err)
+	}
+	slog.Info("Imported sent files log into database", "path", path, "count", imported)
+	return nil
+}
+
+func (s *sqliteStore) MarkSent(records []sentRecord) error {
+	tx, err := s.db.Begin()
+	if err != nil {
+		return fmt.Errorf("failed to write sent files: %w", err)
+	}
+	defer tx.Rollback()
+
+	for _, record := range records {
+		_, err := tx.Exec(`INSERT OR IGNORE INTO sent_files (name, mod_date, hash, size, sent_at) VALUES (?, ?, ?, ?, ?)`, record.Name, record.Date, record.Hash, record.Size, record.SentAt)
+		if err != nil {
+			return fmt.Errorf("failed to write sent files: %w", err)
+		}
+	}
+	return tx.Commit()
+}
+
+func (s *sqliteStore) IsSent(record sentRecord) (bool, error) {
+	query := `SELECT count(*) FROM sent_files WHERE name = ? AND mod_date IN (?, ?)`
+	args := []any{record.Name, record.Date, legacyDate(record.Date)}
+	switch {
+	case record.Hash != "":
+		query = `SELECT count(*) FROM sent_files WHERE name = ? AND hash = ?`
+		args = []any{record.Name, record.Hash}
+	case config.State.Dedup == "name":
+		query = `SELECT count(*) FROM sent_files WHERE name = ?`
+		args = []any{record.Name}
+	case config.State.Dedup == "name_size":
+		query = `SELECT count(*) FROM sent_files WHERE name = ? AND size IN (0, ?)`
+		args = []any{record.Name, record.Size}
+	case record.Date == "":
+		query = `SELECT count(*) FROM sent_files WHERE name = ? AND mod_date = '' AND size = ?`
+		args = []any{record.Name, record.Size}
+	case record.Date == legacyDate(record.Date):
+		query = `SELECT count(*) FROM sent_files WHERE name = ? AND substr(mod_date, 1, 10) = ?`
+		args = []any{record.Name, record.Date}
+	}
+
+	var exists int
+	err := s.db.QueryRow(query, args...).Scan(&exists)
+	if err != nil {
+		return false, err
+	}
+	return exists > 0, nil
+}
+
+func (s *sqliteStore) Prune(cutoff string) (int, error) {
+	// Отметки без даты (сервер не сообщает время) не устаревают
+	result, err := s.db.Exec(`DELETE FROM sent_files WHERE mod_date <> '' AND mod_date < ?`, cutoff)
+	if err != nil {
+		return 0, fmt.Errorf("failed to prune sent files: %w", err)
+	}
+	removed, err := result.RowsAffected()
+	return int(removed), err
+}
+
+func (s *sqliteStore) Close() error {
+	return s.db.Close()
+}
+
+// Хранилище одной отметки времени на задание: отправленными считаются все
+// файлы, измененные не позже нее. Файлы, выложенные с сохранением старого
+// времени изменения, в этом режиме не будут замечены.
+type highwaterStore struct {
+	mu   sync.Mutex
+	path string
+}
+
+// Отметки по заданиям; ключ - имя задания, пустой для конфигурации без заданий
+func (s *highwaterStore) read() (map[string]string, error) {
+	marks := make(map[string]string)
+	content, err := os.ReadFile(s.path)
+	if os.IsNotExist(err) {
+		return marks, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to read highwater state: %w", err)
+	}
+	if err := json.Unmarshal(content, &marks); err != nil {
+		return nil, fmt.Errorf("failed to parse highwater state %s: %w", s.path, err)
+	}
+	return marks, nil
+}
+
+func (s *highwaterStore) IsSent(record sentRecord) (bool, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	marks, err := s.read()
+	if err != nil {
+		return false, err
+	}
+	mark, ok := marks[record.Job]
+	return ok && record.Date <= mark, nil
+}
+
+// Отметка каждого задания сдвигается к наибольшему времени изменения среди
+// его records и никогда не уменьшается
+func (s *highwaterStore) MarkSent(records []sentRecord) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	marks, err := s.read()
+	if err != nil {
+		return err
+	}
+	changed := false
+	for _, record := range records {
+		if record.Date > marks[record.Job] {
+			marks[record.Job] = record.Date
+			changed = true
+		}
+	}
+	if !changed {
+		return nil
+	}
+
+	content, err := json.MarshalIndent(marks, "", "  ")
+	if err != nil {
+		return fmt.Errorf("failed to encode highwater state: %w", err)
+	}
+	return writeFileAtomic(s.path, append(content, '\n'))
+}
+
+// Отметка одна на задание, удалять нечего
+func (s *highwaterStore) Prune(cutoff string) (int, error) {
+	return 0, nil
+}
+
+func (s *highwaterStore) Close() error {
+	return nil
+}
@@ -0,0 +1,112 @@
+package main
+
+import (
+	"database/sql"
+	"path/filepath"
+	"testing"
+)
+
+// Пустая база SQLite; legacyLog - текстовый журнал для переноса
+func setupSQLiteStore(t *testing.T, legacyLog string) *sqliteStore {
+	t.Helper()
+	config = Config{}
+	s, err := openSQLiteStore(filepath.Join(t.TempDir(), "sent_files.db"), legacyLog)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { s.Close() })
+	return s
+}
+
+func isSent(t *testing.T, s sentStore, record sentRecord) bool {
+	t.Helper()
+	sent, err := s.IsSent(record)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return sent
+}
+
+// Файл без времени изменения, размер которого изменился, отмечается заново
+func TestSQLiteStoreWithoutModTimeSizeChange(t *testing.T) {
+	s := setupSQLiteStore(t, filepath.Join(t.TempDir(), "missing.log"))
+
+	old := sentRecord{Name: "release.json", Size: 100}
+	updated := sentRecord{Name: "release.json", Size: 200}
+	if err := s.MarkSent([]sentRecord{old}); err != nil {
+		t.Fatal(err)
+	}
+	if isSent(t, s, updated) {
+		t.Fatalf("file with a new size is recognized as sent before marking")
+	}
+	if err := s.MarkSent([]sentRecord{updated}); err != nil {
+		t.Fatal(err)
+	}
+	if !isSent(t, s, updated) {
+		t.Errorf("file with a new size is not recognized as sent after marking")
+	}
+	if !isSent(t, s, old) {
+		t.Errorf("previous size is no longer recognized as sent")
+	}
+}
+
+// Отметки без времени изменения переносятся из текстового журнала
+func TestSQLiteStoreImportsRecordsWithoutModTime(t *testing.T) {
+	logPath := filepath.Join(t.TempDir(), "sent_files.log")
+	config = Config{}
+	log := &logStore{path: logPath}
+	records := []sentRecord{
+		{Name: "release.json", Size: 100},
+		{Name: "dated.json", Date: "2024-01-02T10:30:00Z"},
+	}
+	if err := log.MarkSent(records); err != nil {
+		t.Fatal(err)
+	}
+
+	s := setupSQLiteStore(t, logPath)
+	for _, record := range records {
+		if !isSent(t, s, record) {
+			t.Errorf("imported record %+v is not recognized as sent", record)
+		}
+	}
+	if isSent(t, s, sentRecord{Name: "release.json", Size: 200}) {
+		t.Errorf("file with a different size is recognized as sent")
+	}
+}
+
+// База с ключом прежних версий (без размера) переводится на новый ключ
+func TestSQLiteStoreUpgradesKey(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "sent_files.db")
+	db, err := sql.Open("sqlite", path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = db.Exec(`CREATE TABLE sent_files (
+		name     TEXT NOT NULL,
+		mod_date TEXT NOT NULL,
+		hash     TEXT NOT NULL DEFAULT '',
+		PRIMARY KEY (name, mod_date, hash)
+	);
+	INSERT INTO sent_files (name, mod_date) VALUES ('dated.json', '2024-01-02')`)
+	db.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	config = Config{}
+	s, err := openSQLiteStore(path, filepath.Join(t.TempDir(), "missing.log"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+	if !isSent(t, s, sentRecord{Name: "dated.json", Date: "2024-01-02T10:30:00Z"}) {
+		t.Errorf("record from the previous schema is lost")
+	}
+	records := []sentRecord{{Name: "release.json", Size: 100}, {Name: "release.json", Size: 200}}
+	if err := s.MarkSent(records); err != nil {
+		t.Fatal(err)
+	}
+	if !isSent(t, s, records[1]) {
+		t.Errorf("file with a new size is not recognized as sent after upgrade")
+	}
+}
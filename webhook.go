@@ -0,0 +1,92 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+	"time"
+)
+
+// Клиент для веб-хуков
+var webhookClient = &http.Client{Timeout: 10 * time.Second}
+
+// Уведомление во входящий веб-хук: по одному запросу на каждую дату
+type webhookNotifier struct {
+	url string
+}
+
+// Тело запроса. Поле text показывают Mattermost и Slack, остальные
+// поля нужны для автоматической обработки.
+type webhookPayload struct {
+	Text  string        `json:"text"`
+	Date  string        `json:"date"`
+	Files []webhookFile `json:"files"`
+}
+
+type webhookFile struct {
+	Name     string `json:"name"`
+	File     string `json:"file"`
+	Platform string `json:"platform"`
+	Version  string `json:"version"`
+	Build    int    `json:"build"`
+}
+
+func (n webhookNotifier) Name() string { return "webhook " + n.url }
+
+func (n webhookNotifier) Notify(ctx context.Context, run *checkRun, src FileSource, groups []releaseGroup) error {
+	for _, group := range sortReleaseGroups(run.Config, groups) {
+		if err := n.post(ctx, run, group); err != nil {
+			return fmt.Errorf("webhook: %w", err)
+		}
+	}
+	return nil
+}
+
+func (n webhookNotifier) post(ctx context.Context, run *checkRun, group releaseGroup) error {
+	payload := webhookPayload{Date: group.Date}
+	lines := []string{fmt.Sprintf("%s от %s", run.SMTP.Text, group.Date)}
+	for _, entry := range group.Data {
+		payload.Files = append(payload.Files, webhookFile{
+			Name:     entry.ZipFileName,
+			File:     entry.TargetFile,
+			Platform: entry.Platform,
+			Version:  entry.displayVersion(),
+			Build:    entry.TeamcityBuildCounter,
+		})
+		lines = append(lines, fmt.Sprintf("- %s (%s, %s)",
+			fieldOrPlaceholder(entry.ZipFileName, "ZipFileName"),
+			fieldOrPlaceholder(platformLabel(run.Config, entry.Platform), "Platform"),
+			fieldOrPlaceholder(entry.displayVersion(), "Version")))
+	}
+	payload.Text = strings.Join(lines, "\n")
+
+	body, err := json.Marshal(payload)
+	if err != nil {
+		return fmt.Errorf("failed to encode payload: %w", err)
+	}
+	if dryRun {
+		fmt.Printf("===== DRY RUN: webhook not sent =====\n%s\n", body)
+		return nil
+	}
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, n.url, bytes.NewReader(body))
+	if err != nil {
+		return fmt.Errorf("failed to create request: %w", err)
+	}
+	req.Header.Set("Content-Type", "application/json")
+	resp, err := webhookClient.Do(req)
+	if err != nil {
+		return fmt.Errorf("failed to post: %w", err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode/100 != 2 {
+		msg, _ := io.ReadAll(io.LimitReader(resp.Body, 512))
+		return fmt.Errorf("unexpected status %s: %s", resp.Status, strings.TrimSpace(string(msg)))
+	}
+	run.log.Debug("Webhook notification sent", "date", group.Date, "count", len(group.Data))
+	return nil
+}